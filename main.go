@@ -2,19 +2,34 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/prometheus/alertmanager/template"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/version"
 
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -26,13 +41,129 @@ import (
 	tmpltext "text/template"
 )
 
+const (
+	signatureHeader      = "X-Signature"
+	requestIDHeader      = "X-Request-Id"
+	defaultIncidentTable = "incident"
+
+	// Maximum sizes of a webhook request body, as received and once decompressed
+	maxRequestBodySize      = 10 << 20
+	maxDecompressedBodySize = 50 << 20
+
+	defaultShortDescription    = "Alerts from Alertmanager"
+	defaultResolveCommentField = "comments"
+	defaultPrometheusLabel     = "prometheus"
+	runbookAnnotation          = "runbook_url"
+	defaultAffectedLabel       = "instance"
+	maxAffectedCIsLength       = 1000
+	shortGroupKeyLength        = 8
+
+	defaultIdempotencyWindow = 5 * time.Minute
+	defaultBufferMaxSize     = 1000
+	bufferDeadLetterDir      = "dead-letter"
+	defaultEmptyResultDelay  = time.Second
+	shutdownTimeout          = 30 * time.Second
+	warmUpRetryInterval      = 5 * time.Second
+	unknownCallerTTL         = time.Hour
+	firingCountTTL           = 24 * time.Hour
+
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 60 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+
+	onGetErrorFail         = "fail"
+	onGetErrorCreateAnyway = "create_anyway"
+
+	emptyGroupLabelsSingle   = "single"
+	emptyGroupLabelsPerAlert = "per_alert"
+	emptyGroupLabelsError    = "error"
+
+	onTemplateErrorBlank = "blank"
+	onTemplateErrorKeep  = "keep"
+	onTemplateErrorSkip  = "skip"
+)
+
+// errIncidentHeld is returned when the creation of an incident is held, as its alert group has not been firing for long enough
+var errIncidentHeld = errors.New("Incident creation held until the alert group has been firing for min_firing_duration")
+
+// errBufferFull is returned when an alert group cannot be buffered while ServiceNow is unavailable, as the buffer holds buffer_max_size alert groups
+var errBufferFull = errors.New("ServiceNow is unavailable and the buffer is full")
+
+// errRequestTooLarge is returned when a webhook request body exceeds the maximum size, compressed or not
+var errRequestTooLarge = errors.New("Request body is too large")
+
+// errProcessingTimeout is returned when the processing of an alert group exceeds the processing_timeout
+var errProcessingTimeout = errors.New("Alert group processing exceeded the processing_timeout")
+
 var (
-	configFile           = kingpin.Flag("config.file", "ServiceNow configuration file.").Default("config/servicenow.yml").String()
+	configFile           = kingpin.Flag("config.file", "ServiceNow configuration file.").Default("config/servicenow.yml").PreAction(setConfigFileExplicit).String()
+	configFileExplicit   bool
 	listenAddress        = kingpin.Flag("web.listen-address", "The address to listen on for HTTP requests.").Default(":9877").String()
+	metricsListenAddress = kingpin.Flag("web.metrics-listen-address", "The address to listen on for metrics and health check HTTP requests. Default is to serve them on web.listen-address.").Default("").String()
+	logSample            = kingpin.Flag("log.sample", "Only log one in N routine info lines of alert group processing. Errors and warnings are never sampled.").Default("1").Uint64()
+	auditFile            = kingpin.Flag("audit.file", "File to append one JSON line to for each ServiceNow incident creation or update, or - for stdout. Default is no audit log.").Default("").String()
 	config               Config
 	serviceNow           ServiceNow
-	noUpdateStates       map[json.Number]bool
+	accessLogger         = log.Base()
+	requestLogger        = log.Base()
+	sampledLines         uint64
+	auditWriter          io.Writer
+	auditMutex           sync.Mutex
+	warmingUp            int32
+	serviceNowDown       int32
+	startTime            = time.Now()
+	now                  = time.Now
+	noUpdateStates       map[string]bool
+	updatableStates      map[string]bool
 	incidentUpdateFields map[string]bool
+	createOnlyFields     map[string]bool
+	incidentTemplates    map[string]compiledTemplate
+	lookupTables         map[string]map[string]string
+
+	// Number of firing alerts of each alert group key, as of the last notification, with its expiration
+	firingCounts      = map[string]firingCount{}
+	firingCountsMutex sync.Mutex
+
+	// Hash of the last processed alert group of each alert group key, with its expiration
+	dedupCache      = map[string]dedupEntry{}
+	dedupCacheMutex sync.Mutex
+
+	// Time of the last firing update of each alert group key
+	lastUpdates      = map[string]time.Time{}
+	lastUpdatesMutex sync.Mutex
+
+	// Alert groups buffered on disk while ServiceNow is unavailable, replayed in order on recovery
+	bufferMutex sync.Mutex
+	bufferDepth int64
+	bufferSeq   uint64
+
+	// Alert group keys being processed under the processing timeout, possibly in the background
+	processing      = map[string]bool{}
+	processingMutex sync.Mutex
+
+	// Incident update of each alert group key delayed by the coalesce window
+	pendingUpdates      = map[string]*pendingUpdate{}
+	pendingUpdatesMutex sync.Mutex
+
+	// sys_id of the ServiceNow users resolved from the caller label, empty for unknown users which expire
+	callerCache      = map[string]callerEntry{}
+	callerCacheMutex sync.Mutex
+
+	defaultSeverityLabel = "severity"
+	defaultSeverities    = []string{"info", "warning", "critical"}
+
+	// ServiceNow default priority lookup, indexed by impact then urgency (1 - High, 2 - Medium, 3 - Low)
+	priorityMatrix = [3][3]string{
+		{"1", "2", "3"},
+		{"2", "3", "4"},
+		{"3", "4", "5"},
+	}
+
+	templateFuncs = tmpltext.FuncMap{
+		"generatorURL": generatorURL,
+		"lookup":       lookup,
+	}
 
 	webhookRequests = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -42,6 +173,76 @@ var (
 		[]string{"code"},
 	)
 
+	auditErrors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "webhook_audit_errors_total",
+			Help: "Total number of audit records which could not be written.",
+		},
+	)
+
+	webhookProcessingTimeouts = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "webhook_processing_timeouts_total",
+			Help: "Total number of alert groups whose processing exceeded the processing timeout.",
+		},
+	)
+
+	webhookBufferDepth = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "webhook_buffer_queue_depth",
+			Help: "Number of alert groups buffered on disk while ServiceNow is unavailable.",
+		},
+	)
+
+	webhookBufferDeadLetters = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "webhook_buffer_dead_letters_total",
+			Help: "Total number of buffered alert groups moved to the dead letter directory as their replay failed permanently.",
+		},
+	)
+
+	webhookHeld = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "webhook_held_total",
+			Help: "Total number of incident creations held as the alert group has not been firing for min_firing_duration.",
+		},
+	)
+
+	webhookUpdatesCoalesced = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "webhook_updates_coalesced_total",
+			Help: "Total number of incident updates merged into a pending update within the coalesce window.",
+		},
+	)
+
+	webhookUpdateThrottled = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "webhook_update_throttled_total",
+			Help: "Total number of incident updates skipped as the incident was updated less than min_update_interval ago.",
+		},
+	)
+
+	webhookResolveDeduped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "webhook_resolve_deduped_total",
+			Help: "Total number of resolved updates skipped as the incident was already in the resolved state.",
+		},
+	)
+
+	webhookDeduped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "webhook_deduped_total",
+			Help: "Total number of alert groups skipped as identical to the last processed one within the dedup TTL.",
+		},
+	)
+
+	webhookRateLimited = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "webhook_rate_limited_total",
+			Help: "Total number of requests on /webhook rejected by the rate limit.",
+		},
+	)
+
 	webhookLastRequest = promauto.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "webhook_last_request_time_seconds",
@@ -56,6 +257,13 @@ var (
 		},
 	)
 
+	webhookSkipBelowSeverity = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "webhook_skip_below_severity_total",
+			Help: "Total number of firing alert groups skipped because their severity is below the configured minimum.",
+		},
+	)
+
 	webhookIncidentTemplateError = promauto.NewCounter(
 		prometheus.CounterOpts{
 			Name: "webhook_incident_template_errors_total",
@@ -78,6 +286,42 @@ var (
 		},
 	)
 
+	serviceNowAuthFailures = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "servicenow_auth_failures_total",
+			Help: "Total number of ServiceNow requests rejected with a 401 status.",
+		},
+	)
+
+	serviceNowMalformedIncident = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "servicenow_malformed_incident_total",
+			Help: "Total number of incidents skipped from ServiceNow responses as they are not JSON objects.",
+		},
+	)
+
+	serviceNowIncidentMissingSysID = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "servicenow_incident_missing_sys_id_total",
+			Help: "Total number of incidents created without a sys_id in the ServiceNow response.",
+		},
+	)
+
+	serviceNowUnexpectedNumberPrefix = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "servicenow_unexpected_number_prefix_total",
+			Help: "Total number of created incidents with a number not starting with the expected prefix.",
+		},
+	)
+
+	// Only registered when the health check is enabled, so that it is not exported as down otherwise
+	serviceNowUp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "servicenow_up",
+			Help: "Whether the last ServiceNow health check was successful (1) or not (0).",
+		},
+	)
+
 	serviceNowError = promauto.NewCounter(
 		prometheus.CounterOpts{
 			Name: "servicenow_errors_total",
@@ -88,50 +332,350 @@ var (
 
 // Config - ServiceNow webhook configuration
 type Config struct {
+	Web             WebConfig         `yaml:"web"`
 	ServiceNow      ServiceNowConfig  `yaml:"service_now"`
 	Workflow        WorkflowConfig    `yaml:"workflow"`
 	DefaultIncident map[string]string `yaml:"default_incident"`
 }
 
+// WebConfig - Webhook HTTP endpoint configuration
+type WebConfig struct {
+	HMACSecret      string          `yaml:"hmac_secret"`
+	BasicAuth       BasicAuthConfig `yaml:"basic_auth"`
+	BearerToken     string          `yaml:"bearer_token"`
+	ProtectMetrics  bool            `yaml:"protect_metrics"`
+	PayloadJSONPath string          `yaml:"payload_json_path"`
+
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+
+	RateLimit      float64 `yaml:"rate_limit"`
+	RateLimitBurst int     `yaml:"rate_limit_burst"`
+
+	WarmUp time.Duration `yaml:"warm_up"`
+}
+
+// BasicAuthConfig - Inbound basic authentication configuration
+type BasicAuthConfig struct {
+	UserName string `yaml:"user_name"`
+	Password string `yaml:"password"`
+}
+
 // ServiceNowConfig - ServiceNow instance configuration
 type ServiceNowConfig struct {
-	InstanceName string `yaml:"instance_name"`
-	UserName     string `yaml:"user_name"`
-	Password     string `yaml:"password"`
+	InstanceName        string        `yaml:"instance_name"`
+	Domain              string        `yaml:"domain"`
+	BaseURL             string        `yaml:"base_url"`
+	UserName            string        `yaml:"user_name"`
+	Password            string        `yaml:"password"`
+	PasswordFile        string        `yaml:"password_file"`
+	NoCount             *bool         `yaml:"no_count"`
+	DisplayValue        string        `yaml:"display_value"`
+	CheckErrorEnvelope  bool          `yaml:"check_error_envelope"`
+	MaxIdleConns        int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+	DisableHTTP2        bool          `yaml:"disable_http2"`
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"`
+	MaxRetries          int           `yaml:"max_retries"`
+	RetryBackoff        time.Duration `yaml:"retry_backoff"`
+	RetryJitter         *bool         `yaml:"retry_jitter"`
+	FailFastThreshold   int           `yaml:"fail_fast_threshold"`
+	QueryNoDomain       bool          `yaml:"query_no_domain"`
+	MaxResponseBytes    int64         `yaml:"max_response_bytes"`
+	MethodOverride      string        `yaml:"method_override"`
+	ResultPath          string        `yaml:"result_path"`
+	ClientCertFile      string        `yaml:"client_cert_file"`
+	ClientKeyFile       string        `yaml:"client_key_file"`
 }
 
 // WorkflowConfig - Incident workflow configuration
 type WorkflowConfig struct {
-	IncidentGroupKeyField string        `yaml:"incident_group_key_field"`
-	NoUpdateStates        []json.Number `yaml:"no_update_states"`
-	IncidentUpdateFields  []string      `yaml:"incident_update_fields"`
+	IncidentGroupKeyField      string             `yaml:"incident_group_key_field"`
+	IncidentGroupKeyValue      string             `yaml:"incident_group_key_value"`
+	NoUpdateStates             []json.Number      `yaml:"no_update_states"`
+	UpdatableStates            []json.Number      `yaml:"updatable_states"`
+	IncidentUpdateFields       []string           `yaml:"incident_update_fields"`
+	SourceLinkField            string             `yaml:"source_link_field"`
+	AlertNamesField            string             `yaml:"alertnames_field"`
+	SeverityLabel              string             `yaml:"severity_label"`
+	Severities                 []string           `yaml:"severities"`
+	MinSeverity                string             `yaml:"min_severity"`
+	UpdateCountField           string             `yaml:"update_count_field"`
+	SearchStates               []json.Number      `yaml:"search_states"`
+	GroupKeyDiscriminatorLabel string             `yaml:"group_key_discriminator_label"`
+	DedupWorkNotes             bool               `yaml:"dedup_work_notes"`
+	ComputePriority            bool               `yaml:"compute_priority"`
+	IdempotencyKeyField        string             `yaml:"idempotency_key_field"`
+	IdempotencyWindow          time.Duration      `yaml:"idempotency_window"`
+	ResolveAllMatches          bool               `yaml:"resolve_all_matches"`
+	ExpectedNumberPrefix       string             `yaml:"expected_number_prefix"`
+	OnGetError                 string             `yaml:"on_get_error"`
+	LookupFile                 string             `yaml:"lookup_file"`
+	OnTemplateError            string             `yaml:"on_template_error"`
+	AllowedCategories          []string           `yaml:"allowed_categories"`
+	FieldFromLabel             map[string]string  `yaml:"field_from_label"`
+	CloseOnFullResolve         bool               `yaml:"close_on_full_resolve"`
+	CloseFields                map[string]string  `yaml:"close_fields"`
+	CreateWorkNote             string             `yaml:"create_work_note"`
+	DeescalateOnPartialResolve DeescalationConfig `yaml:"deescalate_on_partial_resolve"`
+	Escalation                 []EscalationRule   `yaml:"escalation"`
+	ShortDescriptionPrefix     string             `yaml:"short_description_prefix"`
+	ShortDescriptionSuffix     string             `yaml:"short_description_suffix"`
+	ShortDescriptionMaxLength  int                `yaml:"short_description_max_length"`
+
+	DefaultShortDescriptionAnnotation string              `yaml:"default_short_description_annotation"`
+	Transforms                        map[string][]string `yaml:"transforms"`
+	DedupTTL                          time.Duration       `yaml:"dedup_ttl"`
+	MinFiringDuration                 time.Duration       `yaml:"min_firing_duration"`
+	StripInternalLabels               *bool               `yaml:"strip_internal_labels"`
+	LabelDenyList                     []string            `yaml:"label_deny_list"`
+	MajorIncident                     MajorIncidentRule   `yaml:"major_incident"`
+	ResolveComment                    string              `yaml:"resolve_comment"`
+	ResolveCommentField               string              `yaml:"resolve_comment_field"`
+	PrometheusLabel                   string              `yaml:"prometheus_label"`
+	PrometheusField                   string              `yaml:"prometheus_field"`
+	MatchTable                        string              `yaml:"match_table"`
+	GroupLabelFields                  map[string]string   `yaml:"group_label_fields"`
+	StartupDedupWindow                time.Duration       `yaml:"startup_dedup_window"`
+	AlertCountField                   string              `yaml:"alert_count_field"`
+	CallerFromLabel                   string              `yaml:"caller_from_label"`
+	SkipDuplicateComments             bool                `yaml:"skip_duplicate_comments"`
+	TableBySeverity                   map[string]string   `yaml:"table_by_severity"`
+	AssignmentGroupOrder              []string            `yaml:"assignment_group_order"`
+	MinUpdateInterval                 time.Duration       `yaml:"min_update_interval"`
+	CreateOnlyFields                  []string            `yaml:"create_only_fields"`
+	CancelLabel                       string              `yaml:"cancel_label"`
+	CancelFields                      map[string]string   `yaml:"cancel_fields"`
+	LintTemplates                     bool                `yaml:"lint_templates"`
+	RunbookField                      string              `yaml:"runbook_field"`
+	ProcessingTimeout                 time.Duration       `yaml:"processing_timeout"`
+	AffectedLabel                     string              `yaml:"affected_label"`
+	AffectedField                     string              `yaml:"affected_field"`
+	EmptyGroupLabelsStrategy          string              `yaml:"empty_group_labels_strategy"`
+	ReopenState                       json.Number         `yaml:"reopen_state"`
+	ReopenComment                     string              `yaml:"reopen_comment"`
+	MaxAlertsInDescription            int                 `yaml:"max_alerts_in_description"`
+	ShortKeyField                     string              `yaml:"short_key_field"`
+	BufferDir                         string              `yaml:"buffer_dir"`
+	BufferMaxSize                     int                 `yaml:"buffer_max_size"`
+	CategoryFromAlertnamePrefix       map[string]string   `yaml:"category_from_alertname_prefix"`
+	EmptyResultRetries                int                 `yaml:"empty_result_retries"`
+	EmptyResultRetryDelay             time.Duration       `yaml:"empty_result_retry_delay"`
+	GroupFingerprintField             string              `yaml:"group_fingerprint_field"`
+	CoalesceWindow                    time.Duration       `yaml:"coalesce_window"`
+	WebhookVersionField               string              `yaml:"webhook_version_field"`
+}
+
+// MajorIncidentRule - Promotion of the incidents of large alert groups to major incidents
+type MajorIncidentRule struct {
+	MinAlerts  int    `yaml:"min_alerts"`
+	Label      string `yaml:"label"`
+	LabelValue string `yaml:"label_value"`
+	Field      string `yaml:"field"`
+	Value      string `yaml:"value"`
+}
+
+// matches returns whether the rule is enabled, and the alert group has enough firing alerts with the expected common label
+func (r MajorIncidentRule) matches(data template.Data) bool {
+	if len(r.Field) == 0 || r.MinAlerts <= 0 {
+		return false
+	}
+	if len(r.Label) > 0 && data.CommonLabels[r.Label] != r.LabelValue {
+		return false
+	}
+	return len(data.Alerts.Firing()) >= r.MinAlerts
+}
+
+// EscalationRule - Assignment group of an incident that reached a number of firing updates
+type EscalationRule struct {
+	UpdateCount     int    `yaml:"update_count"`
+	AssignmentGroup string `yaml:"assignment_group"`
+}
+
+// DeescalationConfig - Impact and urgency set when the number of firing alerts of an open incident drops
+type DeescalationConfig struct {
+	Impact  string `yaml:"impact"`
+	Urgency string `yaml:"urgency"`
+}
+
+func (d DeescalationConfig) enabled() bool {
+	return len(d.Impact) > 0 || len(d.Urgency) > 0
+}
+
+// TemplateData is the data available in incident templates.
+// It extends the Alertmanager data with computed fields.
+type TemplateData struct {
+	template.Data
+	FiringAlerts     template.Alerts
+	ResolvedAlerts   template.Alerts
+	AlertNames       string
+	Prometheus       string
+	RunbookURL       string
+	AffectedCIs      string
+	AlertCount       int
+	MoreAlerts       string
+	GroupFingerprint string
+	WebhookVersion   string
+	Existing         Incident
+}
+
+// compiledTemplate is a parsed template along with its source text
+type compiledTemplate struct {
+	text string
+	tmpl *tmpltext.Template
 }
 
 // JSONResponse is the Webhook http response
 type JSONResponse struct {
-	Status  int
-	Message string
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// AdminResolveRequest is the body of a bulk resolve request.
+// Incidents are matched either by their group key, or by the group labels of their alert group.
+type AdminResolveRequest struct {
+	GroupKey string            `json:"group_key"`
+	Labels   map[string]string `json:"labels"`
+	Confirm  bool              `json:"confirm"`
+}
+
+// ValidationError describes an invalid incident field
+type ValidationError struct {
+	Field  string
+	Value  string
+	Reason string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("'%s' field value is %s but %s", e.Field, e.Value, e.Reason)
+}
+
+// ValidationErrors lists every invalid field of an incident
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, ". ")
 }
 
 func init() {
 	prometheus.MustRegister(version.NewCollector("alertmanager_webhook_servicenow"))
 }
 
+// enabled reports whether inbound basic authentication is configured, even partially so that an incomplete block is not ignored
+func (b BasicAuthConfig) enabled() bool {
+	return len(b.UserName) > 0 || len(b.Password) > 0
+}
+
+func (w WebConfig) hasAuth() bool {
+	return w.BasicAuth.enabled() || len(w.BearerToken) > 0
+}
+
 func (c Config) validate() error {
 	var errs strings.Builder
 
-	if len(c.ServiceNow.InstanceName) == 0 {
+	if len(c.ServiceNow.InstanceName) == 0 && len(c.ServiceNow.BaseURL) == 0 {
 		errs.WriteString("instance_name is missing\n")
 	}
 	if len(c.ServiceNow.UserName) == 0 {
 		errs.WriteString("user_name is missing\n")
 	}
-	if len(c.ServiceNow.Password) == 0 {
+	if len(c.ServiceNow.Password) == 0 && len(c.ServiceNow.PasswordFile) == 0 {
 		errs.WriteString("password is missing\n")
 	}
+	switch c.ServiceNow.DisplayValue {
+	case "", "true", "false", "all":
+	default:
+		errs.WriteString("display_value must be one of true, false or all\n")
+	}
+	switch c.ServiceNow.MethodOverride {
+	case "", "PUT", "PATCH":
+	default:
+		errs.WriteString("method_override must be one of PUT or PATCH\n")
+	}
+	if c.Web.BasicAuth.enabled() && (len(c.Web.BasicAuth.UserName) == 0 || len(c.Web.BasicAuth.Password) == 0) {
+		errs.WriteString("basic_auth requires both user_name and password\n")
+	}
+	if c.Web.ProtectMetrics && !c.Web.hasAuth() {
+		errs.WriteString("protect_metrics requires basic_auth or bearer_token\n")
+	}
+	if (len(c.ServiceNow.ClientCertFile) > 0) != (len(c.ServiceNow.ClientKeyFile) > 0) {
+		errs.WriteString("client_cert_file and client_key_file must be both set\n")
+	}
 	if len(c.Workflow.IncidentGroupKeyField) == 0 {
 		errs.WriteString("incident_group_key_field is missing\n")
 	}
+	if len(c.Workflow.BufferDir) > 0 && c.ServiceNow.HealthCheckInterval <= 0 {
+		errs.WriteString("buffer_dir requires health_check_interval, which detects ServiceNow unavailability\n")
+	}
+	if len(c.Workflow.ShortKeyField) > 0 && c.Workflow.ShortKeyField == c.Workflow.IncidentGroupKeyField {
+		errs.WriteString("short_key_field must differ from incident_group_key_field\n")
+	}
+	for _, value := range []string{c.Workflow.DeescalateOnPartialResolve.Impact, c.Workflow.DeescalateOnPartialResolve.Urgency} {
+		if _, err := strconv.Atoi(value); len(value) > 0 && err != nil {
+			errs.WriteString("deescalate_on_partial_resolve impact and urgency must be integers\n")
+			break
+		}
+	}
+	for field, transforms := range c.Workflow.Transforms {
+		for _, transform := range transforms {
+			if _, err := applyTransform("", transform); err != nil {
+				errs.WriteString(fmt.Sprintf("transforms of %s: %v\n", field, err))
+			}
+		}
+	}
+	for name, fields := range map[string]map[string]string{"close_fields": c.Workflow.CloseFields, "cancel_fields": c.Workflow.CancelFields} {
+		if len(fields["state"]) > 0 && len(c.ServiceNow.UserName) == 0 && (len(fields["resolved_by"]) == 0 || len(fields["closed_by"]) == 0) {
+			errs.WriteString(fmt.Sprintf("%s with a state requires resolved_by and closed_by when user_name is not set\n", name))
+		}
+	}
+	if len(c.Workflow.CancelLabel) > 0 && len(c.Workflow.CancelFields) == 0 {
+		errs.WriteString("cancel_label requires cancel_fields\n")
+	}
+	if len(c.Workflow.CancelLabel) > 0 && !c.Workflow.CloseOnFullResolve {
+		errs.WriteString("cancel_label requires close_on_full_resolve, as incidents are only closed or cancelled then\n")
+	}
+	for _, source := range c.Workflow.AssignmentGroupOrder {
+		if _, err := assignmentGroupFrom(source, template.Data{}); err != nil {
+			errs.WriteString(fmt.Sprintf("assignment_group_order: %v\n", err))
+		}
+	}
+	if len(c.Workflow.IncidentGroupKeyValue) > 0 {
+		if _, err := tmpltext.New("incident_group_key_value").Funcs(templateFuncs).Parse(c.Workflow.IncidentGroupKeyValue); err != nil {
+			errs.WriteString(fmt.Sprintf("incident_group_key_value is not a valid template: %v\n", err))
+		}
+	}
+	if len(c.Workflow.Escalation) > 0 && len(c.Workflow.UpdateCountField) == 0 {
+		errs.WriteString("escalation requires update_count_field\n")
+	}
+	if len(c.Workflow.NoUpdateStates) > 0 && len(c.Workflow.UpdatableStates) > 0 {
+		errs.WriteString("no_update_states and updatable_states cannot be both set\n")
+	}
+	switch c.Workflow.EmptyGroupLabelsStrategy {
+	case "", emptyGroupLabelsSingle, emptyGroupLabelsPerAlert, emptyGroupLabelsError:
+	default:
+		errs.WriteString("empty_group_labels_strategy must be one of single, per_alert or error\n")
+	}
+	switch c.Workflow.OnGetError {
+	case "", onGetErrorFail, onGetErrorCreateAnyway:
+	default:
+		errs.WriteString("on_get_error must be one of fail or create_anyway\n")
+	}
+	switch c.Workflow.OnTemplateError {
+	case "", onTemplateErrorBlank, onTemplateErrorKeep, onTemplateErrorSkip:
+	default:
+		errs.WriteString("on_template_error must be one of blank, keep or skip\n")
+	}
+	if len(c.Workflow.MinSeverity) > 0 && c.Workflow.severityIndex(c.Workflow.MinSeverity) < 0 {
+		errs.WriteString("min_severity is not one of the configured severities\n")
+	}
 
 	if errs.Len() > 0 {
 		return errors.New("Config file is invalid\n" + errs.String())
@@ -139,19 +683,101 @@ func (c Config) validate() error {
 	return nil
 }
 
+// warnings returns the configuration inconsistencies that do not prevent the webhook from running
+func (c Config) warnings() []string {
+	var warnings []string
+
+	if c.ServiceNow.DisplayValue == "true" || c.ServiceNow.DisplayValue == "all" {
+		for _, state := range c.Workflow.NoUpdateStates {
+			if _, err := state.Int64(); err == nil {
+				warnings = append(warnings, fmt.Sprintf("no_update_states contains the numeric state %s but display_value is %s: "+
+					"incident states are returned as display labels and will never match, use the state labels instead", state, c.ServiceNow.DisplayValue))
+				break
+			}
+		}
+	}
+	if c.Workflow.IncidentGroupKeyField == "short_description" &&
+		(len(c.Workflow.ShortDescriptionPrefix) > 0 || len(c.Workflow.ShortDescriptionSuffix) > 0 || c.Workflow.ShortDescriptionMaxLength > 0) {
+		warnings = append(warnings, "short_description is the incident_group_key_field: short_description_prefix, "+
+			"short_description_suffix and short_description_max_length are ignored")
+	}
+	for _, field := range c.Workflow.CreateOnlyFields {
+		if contains(c.Workflow.IncidentUpdateFields, field) {
+			warnings = append(warnings, fmt.Sprintf("%s is both in incident_update_fields and create_only_fields: it is only set on create", field))
+		}
+	}
+	if c.Workflow.EmptyResultRetries > 0 && c.Workflow.DedupTTL <= 0 {
+		warnings = append(warnings, "empty_result_retries is ignored as dedup_ttl is not set")
+	}
+	if (len(c.Workflow.ReopenState) > 0 || len(c.Workflow.ReopenComment) > 0) && len(c.Workflow.CloseFields["state"]) == 0 {
+		warnings = append(warnings, "reopen_state and reopen_comment are ignored as close_fields has no state")
+	}
+	return warnings
+}
+
 func webhook(w http.ResponseWriter, r *http.Request) {
 
-	data, err := readRequestBody(r)
+	body, err := readRequestBody(w, r)
 	if err != nil {
-		log.Errorf("Error reading request body : %v", err)
+		requestLogger.Errorf("Error reading request body : %v", err)
+		sendJSONResponse(w, bodyErrorStatus(err), err.Error())
+		return
+	}
+
+	// The signature is verified on the raw body, before any decompression
+	err = verifySignature(r.Header.Get(signatureHeader), body)
+	if err != nil {
+		requestLogger.Errorf("Error verifying request signature : %v", err)
+		sendJSONResponse(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	body, err = decompressRequestBody(r, body)
+	if err != nil {
+		requestLogger.Errorf("Error decompressing request body : %v", err)
+		sendJSONResponse(w, bodyErrorStatus(err), err.Error())
+		return
+	}
+
+	data, err := decodeRequestBody(body)
+	if err != nil {
+		requestLogger.Errorf("Error decoding request body : %v", err)
 		sendJSONResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	err = onAlertGroup(data)
+	groups, err := splitAlertGroup(data)
+	if err != nil {
+		requestLogger.Errorf("Error processing alert group : %v", err)
+		sendJSONResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if isBuffering() {
+		if err := bufferAlertGroups(groups); err != nil {
+			requestLogger.Errorf("Error buffering alert group : %v", err)
+			sendJSONResponse(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, "Buffered")
+		return
+	}
+	// Process every alert group, reporting the first error other than a held incident creation
+	for _, group := range groups {
+		if groupErr := onAlertGroupWithTimeout(group); groupErr != nil && (err == nil || err == errIncidentHeld) {
+			err = groupErr
+		}
+	}
 
+	if err == errProcessingTimeout {
+		sendJSONResponse(w, http.StatusGatewayTimeout, err.Error())
+		return
+	}
+	if err == errIncidentHeld {
+		sendJSONResponse(w, http.StatusOK, "Held")
+		return
+	}
 	if err != nil {
-		log.Errorf("Error managing incident from alert : %v", err)
+		requestLogger.Errorf("Error managing incident from alert : %v", err)
 		sendJSONResponse(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -160,7 +786,152 @@ func webhook(w http.ResponseWriter, r *http.Request) {
 	sendJSONResponse(w, http.StatusOK, "Success")
 }
 
+// adminResolve closes, with the configured close fields, the open incidents matching a group key or group labels.
+// It is only available when inbound authentication is configured, and requires an explicit confirmation.
+func adminResolve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONResponse(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	if !config.Web.hasAuth() {
+		writeJSONResponse(w, http.StatusForbidden, "Bulk resolve requires basic_auth or bearer_token to be configured")
+		return
+	}
+	if len(config.Workflow.CloseFields) == 0 {
+		writeJSONResponse(w, http.StatusBadRequest, "Bulk resolve requires close_fields to be configured")
+		return
+	}
+
+	request := AdminResolveRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !request.Confirm {
+		writeJSONResponse(w, http.StatusBadRequest, "Bulk resolve must be confirmed with \"confirm\": true")
+		return
+	}
+
+	data := template.Data{Status: "resolved", GroupLabels: template.KV(request.Labels)}
+	groupKey := request.GroupKey
+	if len(groupKey) == 0 {
+		if len(request.Labels) == 0 {
+			writeJSONResponse(w, http.StatusBadRequest, "Either group_key or labels is required")
+			return
+		}
+		groupKey = getGroupKey(data)
+	}
+	if strings.Contains(groupKey, "^") {
+		// A ^ would alter the encoded query, and match the incidents of other alert groups
+		writeJSONResponse(w, http.StatusBadRequest, "group_key must not contain ^")
+		return
+	}
+
+	fields := closeFields(data)
+	var resolved []string
+	var errs []string
+	// The severity of the alert group is unknown, so that every table of table_by_severity is searched
+	for _, table := range incidentTables() {
+		existingIncidents, err := getIncidentsIn(getIncidentsParams(groupKey), table)
+		if err != nil {
+			serviceNowError.Inc()
+			writeJSONResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		for _, incident := range filterUpdatableIncidents(existingIncidents) {
+			_, err := updateIncidentIn(fields, incident.GetSysID(), table)
+			audit("admin_resolve", groupKey, incident, adminActor(r), err)
+			if err != nil {
+				serviceNowError.Inc()
+				errs = append(errs, err.Error())
+				continue
+			}
+			resolved = append(resolved, incident.GetNumber())
+		}
+	}
+	log.Warnf("Bulk resolved %d incident(s) for group key %s: %v", len(resolved), groupKey, resolved)
+
+	if len(errs) > 0 {
+		writeJSONResponse(w, http.StatusInternalServerError, strings.Join(errs, "; "))
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, fmt.Sprintf("Resolved %d incident(s): %s", len(resolved), strings.Join(resolved, ", ")))
+}
+
+// AuditRecord - Audit log record of a ServiceNow incident creation or update
+type AuditRecord struct {
+	Time           time.Time `json:"time"`
+	Action         string    `json:"action"`
+	GroupKey       string    `json:"group_key"`
+	IncidentNumber string    `json:"incident_number"`
+	SysID          string    `json:"sys_id"`
+	Actor          string    `json:"actor"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// openAuditFile returns the audit log sink: stdout for "-", or the given file opened for appending
+func openAuditFile(path string) (io.Writer, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+}
+
+// audit writes a JSON line recording an incident action to the audit log, when enabled.
+// Each record is written at once without buffering, and a write error is logged without failing the alert group processing.
+func audit(action string, groupKey string, incident Incident, actor string, actionErr error) {
+	if auditWriter == nil {
+		return
+	}
+	record := AuditRecord{
+		Time:           now().UTC(),
+		Action:         action,
+		GroupKey:       groupKey,
+		IncidentNumber: incident.GetNumber(),
+		SysID:          incident.GetSysID(),
+		Actor:          actor,
+	}
+	if actionErr != nil {
+		record.Error = actionErr.Error()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		auditErrors.Inc()
+		log.Errorf("Error marshalling audit record: %v", err)
+		return
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if _, err := auditWriter.Write(append(line, '\n')); err != nil {
+		auditErrors.Inc()
+		log.Errorf("Error writing audit record %s: %v", line, err)
+	}
+}
+
+// adminActor returns the inbound user of an admin request, for the audit log
+func adminActor(r *http.Request) string {
+	if userName, _, ok := r.BasicAuth(); ok {
+		return userName
+	}
+	return "bearer_token"
+}
+
+// sampledInfof logs a routine info line of alert group processing, only one in log.sample lines being logged
+func sampledInfof(format string, args ...interface{}) {
+	sample := *logSample
+	if n := atomic.AddUint64(&sampledLines, 1); sample > 1 && (n-1)%sample != 0 {
+		return
+	}
+	requestLogger.Infof(format, args...)
+}
+
 func homepage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
 	w.Write([]byte(`<html>
 	<head><title>alertmanager-webhook-servicenow</title></head>
 	<body>
@@ -174,7 +945,10 @@ func homepage(w http.ResponseWriter, r *http.Request) {
 // - basic home page on /
 // - Alertmanager webhook entry point on /webhook
 // - health metrics on /metrics
+// - health check on /healthz
+// The metrics and health check handlers are served on a separate listener when a metrics listen address is set.
 func main() {
+	log.AddFlags(kingpin.CommandLine)
 	kingpin.Version(version.Print("alertmanager-webhook-servicenow"))
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
@@ -189,47 +963,549 @@ func main() {
 		log.Fatalf("Error loading ServiceNow client: %v", err)
 	}
 
+	if len(*auditFile) > 0 {
+		auditWriter, err = openAuditFile(*auditFile)
+		if err != nil {
+			log.Fatalf("Error opening audit file: %v", err)
+		}
+	}
+
+	if len(config.Workflow.BufferDir) > 0 {
+		if err := openBuffer(config.Workflow.BufferDir); err != nil {
+			log.Fatalf("Error opening buffer directory: %v", err)
+		}
+	}
+
+	if config.ServiceNow.HealthCheckInterval > 0 {
+		prometheus.MustRegister(serviceNowUp)
+		go runHealthCheck(config.ServiceNow.HealthCheckInterval)
+	}
+
+	if config.Web.WarmUp > 0 {
+		atomic.StoreInt32(&warmingUp, 1)
+		go warmUp(config.Web.WarmUp)
+	}
+
 	log.Info("Starting webhook", version.Info())
 	log.Info("Build context", version.BuildContext())
 
-	http.HandleFunc("/", homepage)
-	http.HandleFunc("/webhook", webhook)
-	http.Handle("/metrics", promhttp.Handler())
+	var servers []*http.Server
+	if len(*metricsListenAddress) == 0 {
+		servers = append(servers, newServer(*listenAddress, accessLog(newServeMux())))
+	} else {
+		webhookMux, metricsMux := newSeparateServeMuxes()
+		servers = append(servers,
+			newServer(*listenAddress, accessLog(webhookMux)),
+			newServer(*metricsListenAddress, accessLog(metricsMux)))
+	}
+
+	for _, server := range servers {
+		go func(server *http.Server) {
+			log.Infof("listening on: %v", server.Addr)
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(server)
+	}
 
-	log.Infof("listening on: %v", *listenAddress)
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	// Wait for a termination signal, then let in-flight requests complete
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	log.Info("Shutting down webhook")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Errorf("Error shutting down listener %v: %v", server.Addr, err)
+		}
+	}
+	flushUpdates()
 }
 
-func sendJSONResponse(w http.ResponseWriter, status int, message string) {
-	webhookRequests.WithLabelValues(strconv.Itoa(status)).Inc()
-	webhookLastRequest.SetToCurrentTime()
+// newServer returns an HTTP server with the timeouts and limits of the web configuration, or safe defaults
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: durationOrDefault(config.Web.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       durationOrDefault(config.Web.ReadTimeout, defaultReadTimeout),
+		WriteTimeout:      durationOrDefault(config.Web.WriteTimeout, defaultWriteTimeout),
+		IdleTimeout:       durationOrDefault(config.Web.IdleTimeout, defaultIdleTimeout),
+		MaxHeaderBytes:    config.Web.MaxHeaderBytes,
+	}
+}
 
-	data := JSONResponse{
-		Status:  status,
-		Message: message,
+func durationOrDefault(d time.Duration, defaultDuration time.Duration) time.Duration {
+	if d <= 0 {
+		return defaultDuration
 	}
-	bytes, _ := json.Marshal(data)
+	return d
+}
 
-	w.WriteHeader(status)
-	_, err := w.Write(bytes)
+// runHealthCheck periodically checks ServiceNow availability, independently of webhook traffic
+func runHealthCheck(interval time.Duration) {
+	checkHealth()
+	for range time.Tick(interval) {
+		checkHealth()
+	}
+}
 
-	if err != nil {
-		log.Errorf("Error writing JSON response: %s", err)
+// warmUp waits for a successful ServiceNow connection check, then for the warm-up duration, before marking the webhook ready
+func warmUp(d time.Duration) {
+	for {
+		err := serviceNow.CheckHealth()
+		if err == nil {
+			break
+		}
+		log.Warnf("ServiceNow connection check failed during warm-up: %v", err)
+		time.Sleep(warmUpRetryInterval)
 	}
+	time.Sleep(d)
+	atomic.StoreInt32(&warmingUp, 0)
+	log.Info("Warm-up complete, webhook is ready")
 }
 
-func readRequestBody(r *http.Request) (template.Data, error) {
+func isReady() bool {
+	return atomic.LoadInt32(&warmingUp) == 0
+}
+
+func checkHealth() {
+	if err := serviceNow.CheckHealth(); err != nil {
+		log.Warnf("ServiceNow health check failed: %v", err)
+		serviceNowUp.Set(0)
+		atomic.StoreInt32(&serviceNowDown, 1)
+		return
+	}
+	serviceNowUp.Set(1)
+	atomic.StoreInt32(&serviceNowDown, 0)
+	if len(config.Workflow.BufferDir) > 0 {
+		replayBuffer()
+	}
+}
+
+// isBuffering reports whether alert groups are buffered instead of processed: when buffer_dir is set, and either ServiceNow is unavailable
+// or the buffer is not replayed yet, so that alert groups are processed in order
+func isBuffering() bool {
+	return len(config.Workflow.BufferDir) > 0 && (atomic.LoadInt32(&serviceNowDown) == 1 || atomic.LoadInt64(&bufferDepth) > 0)
+}
+
+// openBuffer creates the buffer directory, and counts the alert groups left buffered by a previous run
+func openBuffer(dir string) error {
+	if err := os.MkdirAll(filepath.Join(dir, bufferDeadLetterDir), 0700); err != nil {
+		return err
+	}
+	files, err := bufferedFiles(dir)
+	if err != nil {
+		return err
+	}
+	setBufferDepth(int64(len(files)))
+	return nil
+}
+
+// bufferAlertGroups writes each alert group to its own file of the buffer directory.
+// The file names start with the buffering time, so that the alert groups are replayed in order.
+func bufferAlertGroups(groups []template.Data) error {
+	bufferMutex.Lock()
+	defer bufferMutex.Unlock()
+
+	maxSize := config.Workflow.BufferMaxSize
+	if maxSize <= 0 {
+		maxSize = defaultBufferMaxSize
+	}
+	if atomic.LoadInt64(&bufferDepth)+int64(len(groups)) > int64(maxSize) {
+		return errBufferFull
+	}
+
+	for _, group := range groups {
+		content, err := json.Marshal(group)
+		if err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%020d-%010d.json", now().UnixNano(), atomic.AddUint64(&bufferSeq, 1))
+		// Write to a temporary file first, so that a partially written alert group is never replayed
+		path := filepath.Join(config.Workflow.BufferDir, name)
+		if err := ioutil.WriteFile(path+".tmp", content, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+		setBufferDepth(atomic.LoadInt64(&bufferDepth) + 1)
+		log.Infof("ServiceNow is unavailable, alert group key: %s is buffered", getGroupKey(group))
+	}
+	return nil
+}
+
+// replayBuffer processes the buffered alert groups in order, removing each processed one.
+// The replay stops on the first error telling that ServiceNow is unavailable, and is resumed on the next successful health check.
+// Alert groups failing otherwise would fail again on every replay: they are moved to the dead letter directory, so that the next ones are replayed.
+func replayBuffer() {
+	bufferMutex.Lock()
+	defer bufferMutex.Unlock()
+
+	files, err := bufferedFiles(config.Workflow.BufferDir)
+	if err != nil {
+		log.Errorf("Error listing buffered alert groups: %v", err)
+		return
+	}
+	if len(files) > 0 {
+		log.Infof("ServiceNow is available, replaying %d buffered alert group(s)", len(files))
+	}
+	for i, file := range files {
+		path := filepath.Join(config.Workflow.BufferDir, file)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Errorf("Error reading buffered alert group %s: %v", file, err)
+			return
+		}
+		data := template.Data{}
+		err = json.Unmarshal(content, &data)
+		if err == nil {
+			err = onAlertGroupWithTimeout(data)
+		}
+		switch {
+		case isUnavailable(err) || err == errProcessingTimeout:
+			log.Errorf("Error replaying buffered alert group %s, the replay will be resumed on the next health check: %v", file, err)
+			return
+		case err != nil && err != errIncidentHeld:
+			log.Errorf("Error replaying buffered alert group %s, it is moved to the dead letter directory: %v", file, err)
+			if !moveToDeadLetter(file) {
+				return
+			}
+		default:
+			// A held incident creation is dropped as on a live notification, Alertmanager notifies the alert group again
+			if err := os.Remove(path); err != nil {
+				log.Errorf("Error removing replayed alert group %s: %v", file, err)
+				return
+			}
+		}
+		setBufferDepth(int64(len(files) - i - 1))
+	}
+}
+
+// moveToDeadLetter moves a buffered alert group to the dead letter directory, and reports whether it succeeded
+func moveToDeadLetter(file string) bool {
+	path := filepath.Join(config.Workflow.BufferDir, file)
+	if err := os.Rename(path, filepath.Join(config.Workflow.BufferDir, bufferDeadLetterDir, file)); err != nil {
+		log.Errorf("Error moving buffered alert group %s to the dead letter directory: %v", file, err)
+		return false
+	}
+	webhookBufferDeadLetters.Inc()
+	return true
+}
+
+// bufferedFiles returns the sorted file names of the buffered alert groups
+func bufferedFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, info := range infos {
+		if !info.IsDir() && filepath.Ext(info.Name()) == ".json" {
+			files = append(files, info.Name())
+		}
+	}
+	return files, nil
+}
+
+func setBufferDepth(depth int64) {
+	atomic.StoreInt64(&bufferDepth, depth)
+	webhookBufferDepth.Set(float64(depth))
+}
+
+// newServeMux returns a handler serving every endpoint
+func newServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	registerWebhookHandlers(mux)
+	registerMetricsHandlers(mux)
+	return mux
+}
+
+// newSeparateServeMuxes returns a handler serving the webhook endpoints and a handler serving the metrics and health check endpoints
+func newSeparateServeMuxes() (*http.ServeMux, *http.ServeMux) {
+	webhookMux := http.NewServeMux()
+	registerWebhookHandlers(webhookMux)
+
+	metricsMux := http.NewServeMux()
+	registerMetricsHandlers(metricsMux)
+	return webhookMux, metricsMux
+}
+
+func registerWebhookHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/", homepage)
+	// Authentication comes first, so that unauthenticated requests do not use up the rate limit
+	mux.Handle("/webhook", requireReady(authenticate(rateLimit(http.HandlerFunc(webhook)))))
+	mux.Handle("/admin/resolve", authenticate(http.HandlerFunc(adminResolve)))
+}
+
+func registerMetricsHandlers(mux *http.ServeMux) {
+	metricsHandler := promhttp.Handler()
+	if config.Web.ProtectMetrics {
+		metricsHandler = authenticate(metricsHandler)
+	}
+	mux.Handle("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthz)
+}
+
+func healthz(w http.ResponseWriter, r *http.Request) {
+	if !isReady() {
+		http.Error(w, "Not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// statusRecorder is an http.ResponseWriter keeping track of the response status code
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// accessLog wraps a handler to log every HTTP request
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		logger := accessLogger.
+			With("method", r.Method).
+			With("path", r.URL.Path).
+			With("status", recorder.status).
+			With("duration", time.Since(start)).
+			With("remote_addr", r.RemoteAddr)
+		if requestID := r.Header.Get(requestIDHeader); len(requestID) > 0 {
+			logger = logger.With("request_id", requestID)
+		}
+		logger.Info("HTTP request")
+	})
+}
+
+// tokenBucket is a token bucket rate limiter, refilled with rate tokens per second up to burst tokens
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now()}
+}
+
+// allow takes a token from the bucket, if any
+func (b *tokenBucket) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	current := now()
+	b.tokens += current.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = current
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// requireReady wraps a handler, rejecting the requests received during warm-up with a 503 status
+func requireReady(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReady() {
+			w.Header().Set("Retry-After", "1")
+			sendJSONResponse(w, http.StatusServiceUnavailable, "Not ready")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimit wraps a handler with the configured inbound rate limit, rejecting the requests above it with a 429 status
+func rateLimit(next http.Handler) http.Handler {
+	if config.Web.RateLimit <= 0 {
+		return next
+	}
+	bucket := newTokenBucket(config.Web.RateLimit, config.Web.RateLimitBurst)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bucket.allow() {
+			webhookRateLimited.Inc()
+			w.Header().Set("Retry-After", "1")
+			sendJSONResponse(w, http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate wraps a handler with the configured inbound basic or bearer authentication
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !config.Web.hasAuth() || isAuthenticated(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="alertmanager-webhook-servicenow"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+func isAuthenticated(r *http.Request) bool {
+	if config.Web.BasicAuth.enabled() {
+		userName, password, ok := r.BasicAuth()
+		if ok &&
+			subtle.ConstantTimeCompare([]byte(userName), []byte(config.Web.BasicAuth.UserName)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(config.Web.BasicAuth.Password)) == 1 {
+			return true
+		}
+	}
+	if len(config.Web.BearerToken) > 0 {
+		authorization := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if len(token) < len(authorization) && subtle.ConstantTimeCompare([]byte(token), []byte(config.Web.BearerToken)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func sendJSONResponse(w http.ResponseWriter, status int, message string) {
+	webhookRequests.WithLabelValues(strconv.Itoa(status)).Inc()
+	webhookLastRequest.SetToCurrentTime()
+
+	writeJSONResponse(w, status, message)
+}
+
+// writeJSONResponse writes a JSON response, without accounting it as a webhook request
+func writeJSONResponse(w http.ResponseWriter, status int, message string) {
+	data := JSONResponse{
+		Status:  status,
+		Message: message,
+	}
+	bytes, _ := json.Marshal(data)
+
+	w.WriteHeader(status)
+	_, err := w.Write(bytes)
+
+	if err != nil {
+		log.Errorf("Error writing JSON response: %s", err)
+	}
+}
+
+// readRequestBody reads the raw request body, up to maxRequestBodySize
+func readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 
 	// Do not forget to close the body at the end
 	defer r.Body.Close()
 
-	// Extract data from the body in the Data template provided by AlertManager
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil && len(body) >= maxRequestBodySize {
+		return nil, errRequestTooLarge
+	}
+	return body, err
+}
+
+// decompressRequestBody decompresses a gzip request body, up to maxDecompressedBodySize so that a gzip bomb is rejected
+func decompressRequestBody(r *http.Request, body []byte) ([]byte, error) {
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return body, nil
+	}
+
+	gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip body: %v", err)
+	}
+	defer gzipReader.Close()
+
+	// Read one more byte than allowed, to tell a body of exactly the maximum size from a larger one
+	decompressed, err := ioutil.ReadAll(io.LimitReader(gzipReader, maxDecompressedBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip body: %v", err)
+	}
+	if len(decompressed) > maxDecompressedBodySize {
+		return nil, errRequestTooLarge
+	}
+	return decompressed, nil
+}
+
+// bodyErrorStatus returns the status code answering a request body error
+func bodyErrorStatus(err error) int {
+	if err == errRequestTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func decodeRequestBody(body []byte) (template.Data, error) {
+
 	data := template.Data{}
-	err := json.NewDecoder(r.Body).Decode(&data)
+	if len(config.Web.PayloadJSONPath) > 0 {
+		var err error
+		body, err = extractJSONPath(body, config.Web.PayloadJSONPath)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	// Extract data from the body in the Data template provided by AlertManager
+	err := json.NewDecoder(bytes.NewReader(body)).Decode(&data)
 
 	return data, err
 }
 
+// extractJSONPath returns the JSON value found at the dotted path (e.g.: "data.payload") of a JSON object
+func extractJSONPath(body []byte, path string) ([]byte, error) {
+	value := json.RawMessage(body)
+	for _, key := range strings.Split(path, ".") {
+		object := map[string]json.RawMessage{}
+		if err := json.Unmarshal(value, &object); err != nil {
+			return nil, fmt.Errorf("Payload path %s not found: %v", path, err)
+		}
+		var ok bool
+		if value, ok = object[key]; !ok {
+			return nil, fmt.Errorf("Payload path %s not found: missing key %s", path, key)
+		}
+	}
+	return value, nil
+}
+
+// verifySignature checks the hex encoded HMAC-SHA256 signature of the body when a secret is configured
+func verifySignature(signature string, body []byte) error {
+	if len(config.Web.HMACSecret) == 0 {
+		return nil
+	}
+	if len(signature) == 0 {
+		return errors.New("Missing " + signatureHeader + " header")
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return errors.New("Invalid " + signatureHeader + " header")
+	}
+
+	mac := hmac.New(sha256.New, []byte(config.Web.HMACSecret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errors.New("Invalid " + signatureHeader + " header")
+	}
+	return nil
+}
+
 func loadConfigContent(configData []byte) (Config, error) {
 	config = Config{}
 	var err error
@@ -245,151 +1521,1205 @@ func loadConfigContent(configData []byte) (Config, error) {
 	if err != nil {
 		return config, err
 	}
+	for _, warning := range config.warnings() {
+		log.Warn(warning)
+	}
 
 	// Load internal state from config
-	noUpdateStates = make(map[json.Number]bool, len(config.Workflow.NoUpdateStates))
+	noUpdateStates = make(map[string]bool, len(config.Workflow.NoUpdateStates))
 	for _, s := range config.Workflow.NoUpdateStates {
-		noUpdateStates[s] = true
+		noUpdateStates[normalizeState(s)] = true
+	}
+	updatableStates = make(map[string]bool, len(config.Workflow.UpdatableStates))
+	for _, s := range config.Workflow.UpdatableStates {
+		updatableStates[normalizeState(s)] = true
+	}
+
+	// Load internal incidents update fields from config
+	incidentUpdateFields = make(map[string]bool, len(config.Workflow.IncidentUpdateFields))
+	for _, f := range config.Workflow.IncidentUpdateFields {
+		incidentUpdateFields[f] = true
+	}
+	createOnlyFields = make(map[string]bool, len(config.Workflow.CreateOnlyFields))
+	for _, f := range config.Workflow.CreateOnlyFields {
+		createOnlyFields[f] = true
+	}
+
+	// Load lookup tables used by templates
+	lookupTables, err = loadLookupTables(config.Workflow.LookupFile)
+	if err != nil {
+		return config, err
+	}
+
+	// Compile default incident templates
+	incidentTemplates = compileIncidentTemplates(config.DefaultIncident)
+	if config.Workflow.LintTemplates {
+		for _, warning := range lintIncidentTemplates(incidentTemplates) {
+			log.Warn(warning)
+		}
+	}
+	log.Info("ServiceNow config loaded")
+	return config, nil
+}
+
+// setConfigFileExplicit records that the config file is given on the command line, so that it must exist
+func setConfigFileExplicit(*kingpin.ParseContext) error {
+	configFileExplicit = true
+	return nil
+}
+
+func loadConfig(configFile string) (Config, error) {
+	info, err := os.Stat(configFile)
+	if os.IsNotExist(err) && !configFileExplicit {
+		// In container deployments, the whole config may come from environment variables
+		log.Warnf("Config file %s not found, loading the config from environment variables only", configFile)
+		return loadConfigContent(nil)
+	}
+	if err != nil {
+		return Config{}, err
+	}
+
+	var configData []byte
+	if info.IsDir() {
+		configData, err = mergeConfigDir(configFile)
+	} else {
+		// Load the config from the file
+		configData, err = ioutil.ReadFile(configFile)
+	}
+	if err != nil {
+		return Config{}, err
+	}
+
+	return loadConfigContent(configData)
+}
+
+// mergeConfigDir merges the *.yml config fragments of a directory, in lexical order, into a single YAML config.
+// Maps are merged, while scalar and list values of a fragment override the ones of the previous fragments.
+func mergeConfigDir(configDir string) ([]byte, error) {
+	files, err := filepath.Glob(filepath.Join(configDir, "*.yml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No *.yml config file found in %s", configDir)
+	}
+	sort.Strings(files)
+
+	merged := map[interface{}]interface{}{}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		fragment := map[interface{}]interface{}{}
+		if err := yaml.Unmarshal(content, &fragment); err != nil {
+			return nil, fmt.Errorf("Error parsing %s: %v", file, err)
+		}
+		mergeYAMLMaps(merged, fragment)
+	}
+	return yaml.Marshal(merged)
+}
+
+func mergeYAMLMaps(dst map[interface{}]interface{}, src map[interface{}]interface{}) {
+	for k, v := range src {
+		srcMap, srcIsMap := v.(map[interface{}]interface{})
+		dstMap, dstIsMap := dst[k].(map[interface{}]interface{})
+		if srcIsMap && dstIsMap {
+			mergeYAMLMaps(dstMap, srcMap)
+		} else {
+			dst[k] = v
+		}
+	}
+}
+
+// loadLookupTables loads the YAML lookup file, holding a map of key/value tables indexed by table name
+func loadLookupTables(lookupFile string) (map[string]map[string]string, error) {
+	tables := map[string]map[string]string{}
+	if len(lookupFile) == 0 {
+		return tables, nil
+	}
+
+	content, err := ioutil.ReadFile(lookupFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(content, &tables); err != nil {
+		return nil, fmt.Errorf("Lookup file %s is invalid: %v", lookupFile, err)
+	}
+	log.Infof("Loaded %v lookup table(s) from %s", len(tables), lookupFile)
+	return tables, nil
+}
+
+func loadEnvVars(c *Config) {
+	if instanceName, ok := os.LookupEnv("SERVICENOW_INSTANCE_NAME"); ok {
+		(*c).ServiceNow.InstanceName = instanceName
+	}
+	if userName, ok := os.LookupEnv("SERVICENOW_USERNAME"); ok {
+		(*c).ServiceNow.UserName = userName
+	}
+	if password, ok := os.LookupEnv("SERVICENOW_PASSWORD"); ok {
+		(*c).ServiceNow.Password = password
+	}
+	if incidentField, ok := os.LookupEnv("SERVICENOW_INCIDENT_GROUP_KEY_FIELD"); ok {
+		(*c).Workflow.IncidentGroupKeyField = incidentField
+	}
+}
+
+func loadSnClient() (ServiceNow, error) {
+	baseURL := config.ServiceNow.BaseURL
+	if len(baseURL) == 0 && len(config.ServiceNow.InstanceName) > 0 {
+		baseURL = instanceURL(config.ServiceNow.InstanceName, config.ServiceNow.Domain)
+	}
+	password := config.ServiceNow.Password
+	if len(config.ServiceNow.PasswordFile) > 0 {
+		var err error
+		if password, err = readPasswordFile(config.ServiceNow.PasswordFile); err != nil {
+			return serviceNow, err
+		}
+	}
+	snClient, err := NewServiceNowClientWithBaseURL(baseURL, config.ServiceNow.UserName, password)
+	if err != nil {
+		return serviceNow, err
+	}
+	snClient.passwordFile = config.ServiceNow.PasswordFile
+	transport := newTransport(config.ServiceNow.MaxIdleConns, config.ServiceNow.MaxIdleConnsPerHost, config.ServiceNow.IdleConnTimeout)
+	if config.ServiceNow.DisableHTTP2 {
+		disableHTTP2(transport)
+	}
+	if len(config.ServiceNow.ClientCertFile) > 0 {
+		if err := setClientCertificate(transport, config.ServiceNow.ClientCertFile, config.ServiceNow.ClientKeyFile); err != nil {
+			return serviceNow, err
+		}
+	}
+	snClient.client = &http.Client{Transport: transport}
+	snClient.displayValue = config.ServiceNow.DisplayValue
+	snClient.checkErrorEnvelope = config.ServiceNow.CheckErrorEnvelope
+	snClient.matchTable = config.Workflow.MatchTable
+	if config.ServiceNow.NoCount != nil {
+		snClient.noCount = *config.ServiceNow.NoCount
+	}
+	snClient.maxRetries = config.ServiceNow.MaxRetries
+	if config.ServiceNow.RetryBackoff > 0 {
+		snClient.retryBackoff = config.ServiceNow.RetryBackoff
+	}
+	if config.ServiceNow.RetryJitter != nil {
+		snClient.retryJitter = *config.ServiceNow.RetryJitter
+	}
+	snClient.failFastThreshold = int32(config.ServiceNow.FailFastThreshold)
+	snClient.queryNoDomain = config.ServiceNow.QueryNoDomain
+	snClient.maxResponseBytes = config.ServiceNow.MaxResponseBytes
+	snClient.methodOverride = config.ServiceNow.MethodOverride
+	snClient.resultPath = config.ServiceNow.ResultPath
+	serviceNow = snClient
+	return serviceNow, nil
+}
+
+// splitAlertGroup applies the empty_group_labels_strategy to an alert group without group labels (Alertmanager group_by: []),
+// which would otherwise collapse all alerts into a single incident: the alert group is kept as is (single), rejected (error),
+// or split into one alert group per alert, grouped by all its labels (per_alert).
+func splitAlertGroup(data template.Data) ([]template.Data, error) {
+	if len(data.GroupLabels) > 0 {
+		return []template.Data{data}, nil
+	}
+	switch config.Workflow.EmptyGroupLabelsStrategy {
+	case emptyGroupLabelsError:
+		return nil, errors.New("Alert group without group labels rejected by the empty_group_labels_strategy")
+	case emptyGroupLabelsPerAlert:
+		groups := make([]template.Data, 0, len(data.Alerts))
+		for _, alert := range data.Alerts {
+			groups = append(groups, template.Data{
+				Receiver:          data.Receiver,
+				Status:            alert.Status,
+				Alerts:            template.Alerts{alert},
+				GroupLabels:       alert.Labels,
+				CommonLabels:      alert.Labels,
+				CommonAnnotations: alert.Annotations,
+				ExternalURL:       data.ExternalURL,
+			})
+		}
+		return groups, nil
+	default:
+		return []template.Data{data}, nil
+	}
+}
+
+// onAlertGroupWithTimeout processes an alert group within the processing timeout, if configured, or returns errProcessingTimeout.
+// As ServiceNow requests are not cancellable, the processing goes on in the background after a timeout, and its outcome is logged.
+// Until it completes, the alert group key is not processed again, so that a retried notification does not create a duplicate incident.
+func onAlertGroupWithTimeout(data template.Data) error {
+	if config.Workflow.ProcessingTimeout <= 0 {
+		return onAlertGroup(data)
+	}
+
+	groupKey := getGroupKey(data)
+	if !startProcessing(groupKey) {
+		requestLogger.Warnf("Alert group key: %s is still being processed in the background, it will be processed on the next notification", groupKey)
+		return errProcessingTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Workflow.ProcessingTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		defer finishProcessing(groupKey)
+		done <- onAlertGroup(data)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		webhookProcessingTimeouts.Inc()
+		requestLogger.Errorf("Processing of alert group key: %s exceeded %v, it goes on in the background", groupKey, config.Workflow.ProcessingTimeout)
+		go func() {
+			if err := <-done; err != nil {
+				requestLogger.Errorf("Background processing of alert group key: %s failed after the processing timeout: %v", groupKey, err)
+				return
+			}
+			requestLogger.Infof("Background processing of alert group key: %s completed after the processing timeout", groupKey)
+		}()
+		return errProcessingTimeout
+	}
+}
+
+// startProcessing marks an alert group key as being processed, and reports whether it was not already
+func startProcessing(groupKey string) bool {
+	processingMutex.Lock()
+	defer processingMutex.Unlock()
+
+	if processing[groupKey] {
+		return false
+	}
+	processing[groupKey] = true
+	return true
+}
+
+// finishProcessing marks the processing of an alert group key as completed
+func finishProcessing(groupKey string) {
+	processingMutex.Lock()
+	defer processingMutex.Unlock()
+
+	delete(processing, groupKey)
+}
+
+func onAlertGroup(data template.Data) (err error) {
+
+	sampledInfof("Received alert group: Status=%s, GroupLabels=%v, CommonLabels=%v, CommonAnnotations=%v",
+		data.Status, data.GroupLabels, data.CommonLabels, data.CommonAnnotations)
+
+	// The group key is rendered once, as incident_group_key_value may be an expensive template
+	groupKey := getGroupKey(data)
+
+	if data.Status == "firing" && isBelowMinSeverity(data) {
+		webhookSkipBelowSeverity.Inc()
+		log.Infof("Skipping firing alert group key: %s as its severity is below %s", groupKey, config.Workflow.MinSeverity)
+		return nil
+	}
+
+	if config.Workflow.DedupTTL > 0 {
+		hash := alertGroupHash(data)
+		if isDuplicate(groupKey, hash) {
+			webhookDeduped.Inc()
+			log.Infof("Skipping alert group key: %s as it is identical to the last processed one", groupKey)
+			return nil
+		}
+		defer func() {
+			if err == nil {
+				recordProcessed(groupKey, hash, data.Status == "firing")
+			}
+		}()
+	}
+
+	err = processAlertGroup(data, groupKey)
+	if err == errConflict && data.Status == "firing" {
+		// A conflict is returned by a uniqueness business rule, when another replica created the incident concurrently
+		log.Warnf("Incident creation conflicted for alert group key: %s, retrying once to update the existing incident", groupKey)
+		err = processAlertGroup(data, groupKey)
+	}
+	return err
+}
+
+// processAlertGroup finds the updatable incidents of an alert group, then creates, updates or resolves them
+func processAlertGroup(data template.Data, groupKey string) error {
+	existingIncidents, err := getExistingIncidents(groupKey, incidentTable(data))
+	if err != nil {
+		serviceNowError.Inc()
+		// Within the startup dedup window, an incident created before the restart may exist: none is created blindly
+		if data.Status != "firing" || config.Workflow.OnGetError != onGetErrorCreateAnyway || inStartupDedupWindow() {
+			return err
+		}
+		log.Errorf("Error getting existing incidents for alert group key: %s, an incident will be created anyway and may be a duplicate: %v", groupKey, err)
+	}
+	sampledInfof("Found %v existing incident(s) for alert group key: %s.", len(existingIncidents), groupKey)
+
+	updatableIncidents := filterUpdatableIncidents(existingIncidents)
+	sampledInfof("Found %v updatable incident(s) for alert group key: %s.", len(updatableIncidents), groupKey)
+
+	var updatableIncident Incident
+	if len(updatableIncidents) > 0 {
+		updatableIncident = updatableIncidents[0]
+
+		if len(updatableIncidents) > 1 && !(data.Status == "resolved" && config.Workflow.ResolveAllMatches) {
+			log.Warnf("As multiple updable incidents were found for alert group key: %s, first one will be used: %s", groupKey, updatableIncident.GetNumber())
+		}
+	}
+
+	if data.Status == "firing" {
+		return onFiringGroup(data, groupKey, updatableIncident)
+	} else if data.Status == "resolved" {
+		if !config.Workflow.ResolveAllMatches && len(updatableIncidents) > 1 {
+			updatableIncidents = updatableIncidents[:1]
+		}
+		return onResolvedGroup(data, groupKey, updatableIncidents)
+	} else {
+		log.Errorf("Unknown alert group status: %s", data.Status)
+	}
+
+	return nil
+}
+
+// getExistingIncidents searches the incidents of an alert group key.
+// When none is found although the dedup cache expects one, the search is retried up to empty_result_retries times,
+// as an incident created just before may not be returned yet by ServiceNow (replication lag).
+// Within the startup dedup window, the dedup cache filled before the restart is lost: an incident is always expected, and searched again at least once.
+func getExistingIncidents(groupKey string, table string) ([]Incident, error) {
+	retries := config.Workflow.EmptyResultRetries
+	startup := inStartupDedupWindow()
+	if startup && retries == 0 {
+		retries = 1
+	}
+	incidents, err := getIncidentsIn(getIncidentsParams(groupKey), table)
+	for retry := 0; retry < retries && err == nil && len(incidents) == 0 && (startup || expectsIncident(groupKey)); retry++ {
+		delay := durationOrDefault(config.Workflow.EmptyResultRetryDelay, defaultEmptyResultDelay)
+		log.Infof("Found no incident for recently processed alert group key: %s, searching again in %v", groupKey, delay)
+		time.Sleep(delay)
+		incidents, err = getIncidentsIn(getIncidentsParams(groupKey), table)
+	}
+	return incidents, err
+}
+
+// inStartupDedupWindow reports whether the webhook started less than startup_dedup_window ago.
+// Within this window, the in-memory state lost on restart is not trusted, and an empty search is checked against ServiceNow again.
+func inStartupDedupWindow() bool {
+	return config.Workflow.StartupDedupWindow > 0 && now().Sub(startTime) < config.Workflow.StartupDedupWindow
+}
+
+type dedupEntry struct {
+	hash    string
+	firing  bool
+	expires time.Time
+}
+
+// alertGroupHash returns a hash of the whole alert group, so that repeated notifications of an unchanged group can be identified
+func alertGroupHash(data template.Data) string {
+	content, _ := json.Marshal(data)
+	hash := md5.Sum(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// isDuplicate reports whether the alert group is identical to the last processed one of its key, within the dedup TTL
+func isDuplicate(groupKey string, hash string) bool {
+	dedupCacheMutex.Lock()
+	defer dedupCacheMutex.Unlock()
+
+	entry, ok := dedupCache[groupKey]
+	return ok && entry.hash == hash && now().Before(entry.expires)
+}
+
+// recordProcessed records the hash of a processed alert group, and evicts the expired entries
+func recordProcessed(groupKey string, hash string, firing bool) {
+	dedupCacheMutex.Lock()
+	defer dedupCacheMutex.Unlock()
+
+	current := now()
+	for key, entry := range dedupCache {
+		if !current.Before(entry.expires) {
+			delete(dedupCache, key)
+		}
+	}
+	dedupCache[groupKey] = dedupEntry{hash: hash, firing: firing, expires: current.Add(config.Workflow.DedupTTL)}
+}
+
+// expectsIncident reports whether a firing alert group of the key was processed within the dedup TTL, so that its incident should exist
+func expectsIncident(groupKey string) bool {
+	dedupCacheMutex.Lock()
+	defer dedupCacheMutex.Unlock()
+
+	entry, ok := dedupCache[groupKey]
+	return ok && entry.firing && now().Before(entry.expires)
+}
+
+type callerEntry struct {
+	sysID   string
+	expires time.Time
+}
+
+// resolveCaller returns the sys_id of the ServiceNow user with the given user name or email, or an empty string when it is unknown.
+// Lookups are cached, except failed ones which are retried on the next alert group. Unknown users are only cached for the
+// unknownCallerTTL, so that arbitrary label values do not pile up and users created since are found.
+func resolveCaller(user string) string {
+	if len(user) == 0 {
+		return ""
+	}
+
+	callerCacheMutex.Lock()
+	entry, ok := callerCache[user]
+	callerCacheMutex.Unlock()
+	if ok && (len(entry.sysID) > 0 || now().Before(entry.expires)) {
+		return entry.sysID
+	}
+
+	callerID, err := serviceNow.GetUserSysID(user)
+	if err != nil {
+		serviceNowError.Inc()
+		log.Errorf("Error resolving caller %s, the default caller will be used: %v", user, err)
+		return ""
+	}
+	if len(callerID) == 0 {
+		log.Warnf("No ServiceNow user found for caller %s, the default caller will be used", user)
+	}
+
+	callerCacheMutex.Lock()
+	current := now()
+	for key, entry := range callerCache {
+		if len(entry.sysID) == 0 && !current.Before(entry.expires) {
+			delete(callerCache, key)
+		}
+	}
+	callerCache[user] = callerEntry{sysID: callerID, expires: current.Add(unknownCallerTTL)}
+	callerCacheMutex.Unlock()
+	return callerID
+}
+
+// getIncidentsParams returns the query parameters used to find the existing incidents of an alert group.
+// When search states are configured, they are added to the query so that ServiceNow filters them server-side.
+func getIncidentsParams(groupKey string) map[string]string {
+	if len(config.Workflow.SearchStates) == 0 {
+		return map[string]string{
+			config.Workflow.IncidentGroupKeyField: groupKey,
+		}
+	}
+
+	states := make([]string, len(config.Workflow.SearchStates))
+	for i, state := range config.Workflow.SearchStates {
+		states[i] = state.String()
+	}
+	return map[string]string{
+		"sysparm_query": fmt.Sprintf("%s=%s^stateIN%s", config.Workflow.IncidentGroupKeyField, groupKey, strings.Join(states, ",")),
+	}
+}
+
+// incidentTable returns the table in which the incident of an alert group is created, searched and updated, from its severity and table_by_severity
+func incidentTable(data template.Data) string {
+	label := config.Workflow.SeverityLabel
+	if len(label) == 0 {
+		label = defaultSeverityLabel
+	}
+	if table, ok := config.Workflow.TableBySeverity[data.CommonLabels[label]]; ok && len(table) > 0 {
+		return table
+	}
+	return defaultIncidentTable
+}
+
+// incidentTables returns the incident table followed by the sorted tables of table_by_severity, each table once
+func incidentTables() []string {
+	tables := []string{defaultIncidentTable}
+	for _, table := range config.Workflow.TableBySeverity {
+		if len(table) > 0 && !contains(tables, table) {
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables[1:])
+	return tables
+}
+
+// getIncidentsIn searches incidents in a table. The incident table is searched through the match_table, when configured.
+func getIncidentsIn(params map[string]string, table string) ([]Incident, error) {
+	if table == defaultIncidentTable {
+		return serviceNow.GetIncidents(params)
+	}
+	return serviceNow.GetIncidentsInTable(params, table)
+}
+
+// createIncidentIn creates an incident in a table
+func createIncidentIn(incidentParam Incident, table string) (Incident, error) {
+	if table == defaultIncidentTable {
+		return serviceNow.CreateIncident(incidentParam)
+	}
+	return serviceNow.CreateIncidentInTable(incidentParam, table)
+}
+
+// updateIncidentIn updates an incident of a table
+func updateIncidentIn(incidentParam Incident, sysID string, table string) (Incident, error) {
+	if table == defaultIncidentTable {
+		return serviceNow.UpdateIncident(incidentParam, sysID)
+	}
+	return serviceNow.UpdateIncidentInTable(incidentParam, sysID, table)
+}
+
+// severityIndex returns the rank of the given severity in the configured severities, or -1 if it is unknown
+func (w WorkflowConfig) severityIndex(severity string) int {
+	severities := w.Severities
+	if len(severities) == 0 {
+		severities = defaultSeverities
+	}
+	for i, s := range severities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+// isBelowMinSeverity checks if the alert group severity is lower than the configured minimum severity.
+// Alert groups without a known severity are never considered below the minimum.
+func isBelowMinSeverity(data template.Data) bool {
+	if len(config.Workflow.MinSeverity) == 0 {
+		return false
+	}
+
+	label := config.Workflow.SeverityLabel
+	if len(label) == 0 {
+		label = defaultSeverityLabel
+	}
+
+	index := config.Workflow.severityIndex(data.CommonLabels[label])
+	return index >= 0 && index < config.Workflow.severityIndex(config.Workflow.MinSeverity)
+}
+
+func onFiringGroup(data template.Data, groupKey string, updatableIncident Incident) error {
+	table := incidentTable(data)
+	incidentCreateParam, err := groupKeyIncident(data, groupKey, updatableIncident)
+	if err != nil {
+		return err
+	}
+
+	incidentUpdateParam := filterForUpdate(incidentCreateParam)
+
+	if len(config.Workflow.UpdateCountField) > 0 {
+		incidentCreateParam[config.Workflow.UpdateCountField] = "1"
+		if updatableIncident != nil {
+			incidentUpdateParam[config.Workflow.UpdateCountField] = nextUpdateCount(updatableIncident)
+			escalate(incidentUpdateParam, updatableIncident)
+		}
+	}
+
+	if rule := config.Workflow.MajorIncident; rule.matches(data) {
+		log.Infof("Alert group key: %s has %d firing alerts, incident is promoted to major incident", groupKey, len(data.Alerts.Firing()))
+		incidentCreateParam[rule.Field] = rule.Value
+		incidentUpdateParam[rule.Field] = rule.Value
+	}
+
+	if updatableIncident == nil {
+		sampledInfof("Found no updatable incident for firing alert group key: %s", groupKey)
+		if startsAt := oldestFiringStartsAt(data); config.Workflow.MinFiringDuration > 0 && now().Sub(startsAt) < config.Workflow.MinFiringDuration {
+			webhookHeld.Inc()
+			log.Infof("Holding incident creation for alert group key: %s, firing since %v", groupKey, startsAt)
+			return errIncidentHeld
+		}
+		if config.Workflow.DeescalateOnPartialResolve.enabled() {
+			firingCountDropped(groupKey, len(data.Alerts.Firing()))
+		}
+		if len(config.Workflow.IdempotencyKeyField) > 0 {
+			key := idempotencyKey(groupKey)
+			existingIncidents, err := getIncidentsIn(map[string]string{config.Workflow.IdempotencyKeyField: key}, table)
+			if err != nil {
+				serviceNowError.Inc()
+				return err
+			}
+			if len(existingIncidents) > 0 {
+				log.Infof("Found incident (%s) with idempotency key: %s. No incident will be created.", existingIncidents[0].GetNumber(), key)
+				return nil
+			}
+			incidentCreateParam[config.Workflow.IdempotencyKeyField] = key
+		}
+		if len(config.Workflow.CallerFromLabel) > 0 {
+			if callerID := resolveCaller(data.CommonLabels[config.Workflow.CallerFromLabel]); len(callerID) > 0 {
+				incidentCreateParam["caller_id"] = callerID
+			}
+		}
+		if len(config.Workflow.CreateWorkNote) > 0 {
+			workNote, err := applyTemplate("create_work_note", config.Workflow.CreateWorkNote, newTemplateData(data))
+			if err != nil {
+				log.Errorf("Error applying create_work_note template: %v", err)
+			} else {
+				incidentCreateParam["work_notes"] = workNote
+			}
+		}
+		flushUpdate(groupKey)
+		createdIncident, err := createIncidentIn(incidentCreateParam, table)
+		audit("create", groupKey, createdIncident, config.ServiceNow.UserName, err)
+		if err != nil {
+			serviceNowError.Inc()
+			return err
+		}
+		if len(createdIncident.GetSysID()) == 0 {
+			recoverSysID(createdIncident, table)
+		}
+		if !createdIncident.IsNumberMissing() {
+			checkNumberPrefix(createdIncident)
+		}
+	} else {
+		sampledInfof("Found updatable incident (%s), with state %s, for firing alert group key: %s", updatableIncident.GetNumber(), updatableIncident.GetState(), groupKey)
+		if config.Workflow.MinUpdateInterval > 0 && !updateAllowed(groupKey) {
+			webhookUpdateThrottled.Inc()
+			log.Infof("Skipping update of incident %s as it was updated less than %v ago", updatableIncident.GetNumber(), config.Workflow.MinUpdateInterval)
+			return nil
+		}
+		if config.Workflow.DedupWorkNotes {
+			dedupWorkNotes(incidentUpdateParam, updatableIncident)
+		}
+		if config.Workflow.SkipDuplicateComments {
+			skipDuplicateComments(incidentUpdateParam, updatableIncident)
+		}
+		if config.Workflow.DeescalateOnPartialResolve.enabled() && firingCountDropped(groupKey, len(data.Alerts.Firing())) {
+			deescalate(incidentUpdateParam, updatableIncident)
+		}
+		action := "update"
+		if isReopened(updatableIncident, data) {
+			log.Infof("Incident %s is in the resolved state %s, it will be reopened for firing alert group key: %s", updatableIncident.GetNumber(), updatableIncident.GetState(), groupKey)
+			reopen(incidentUpdateParam, data)
+			action = "reopen"
+		}
+		if config.Workflow.CoalesceWindow > 0 {
+			coalesceUpdate(groupKey, incidentUpdateParam, updatableIncident, table, action)
+			return nil
+		}
+		return updateIncident(groupKey, incidentUpdateParam, updatableIncident, table, action)
+	}
+	return nil
+}
+
+// updateIncident sends the update of the incident of an alert group key, and audits it
+func updateIncident(groupKey string, incidentUpdateParam Incident, incident Incident, table string, action string) error {
+	_, err := updateIncidentIn(incidentUpdateParam, incident.GetSysID(), table)
+	audit(action, groupKey, incident, config.ServiceNow.UserName, err)
+	if err != nil {
+		serviceNowError.Inc()
+		return err
+	}
+	if config.Workflow.MinUpdateInterval > 0 {
+		recordUpdate(groupKey)
+	}
+	return nil
+}
+
+type pendingUpdate struct {
+	incidentUpdateParam Incident
+	incident            Incident
+	table               string
+	action              string
+	timer               *time.Timer
+}
+
+// coalesceUpdate delays the update of the incident of an alert group key by the coalesce_window.
+// The updates received in the meantime are merged into the pending one, the latest values winning, so that a single update is sent.
+func coalesceUpdate(groupKey string, incidentUpdateParam Incident, incident Incident, table string, action string) {
+	pendingUpdatesMutex.Lock()
+	defer pendingUpdatesMutex.Unlock()
+
+	pending, ok := pendingUpdates[groupKey]
+	if !ok {
+		sampledInfof("Delaying update of incident %s by the coalesce window for alert group key: %s", incident.GetNumber(), groupKey)
+		pendingUpdates[groupKey] = &pendingUpdate{
+			incidentUpdateParam: incidentUpdateParam,
+			incident:            incident,
+			table:               table,
+			action:              action,
+			timer:               time.AfterFunc(config.Workflow.CoalesceWindow, func() { flushUpdate(groupKey) }),
+		}
+		return
+	}
+
+	webhookUpdatesCoalesced.Inc()
+	for k, v := range incidentUpdateParam {
+		pending.incidentUpdateParam[k] = v
+	}
+	pending.incident = incident
+	pending.table = table
+	// A reopen is kept, as the merged update holds the reopen state
+	if pending.action != "reopen" {
+		pending.action = action
+	}
+}
+
+// flushUpdate sends the pending update of an alert group key, if any, without waiting for the end of the coalesce window.
+// As the alert group notifications were already answered, an update failing as ServiceNow is unavailable is kept pending
+// for the next flush. Other errors would fail again, the update is lost.
+func flushUpdate(groupKey string) {
+	pendingUpdatesMutex.Lock()
+	pending, ok := pendingUpdates[groupKey]
+	if ok {
+		pending.timer.Stop()
+		delete(pendingUpdates, groupKey)
+	}
+	pendingUpdatesMutex.Unlock()
+
+	if !ok {
+		return
+	}
+	err := updateIncident(groupKey, pending.incidentUpdateParam, pending.incident, pending.table, pending.action)
+	if isUnavailable(err) {
+		log.Errorf("Error sending the coalesced update of incident %s for alert group key: %s, it is kept for the next flush: %v", pending.incident.GetNumber(), groupKey, err)
+		keepPending(groupKey, pending)
+	} else if err != nil {
+		log.Errorf("Error sending the coalesced update of incident %s for alert group key: %s: %v", pending.incident.GetNumber(), groupKey, err)
+	}
+}
+
+// keepPending puts back a failed update as the pending update of an alert group key, to be sent at the end of a new coalesce window.
+// An update received in the meantime is merged over it, its values winning.
+func keepPending(groupKey string, failed *pendingUpdate) {
+	pendingUpdatesMutex.Lock()
+	defer pendingUpdatesMutex.Unlock()
+
+	pending, ok := pendingUpdates[groupKey]
+	if !ok {
+		failed.timer = time.AfterFunc(config.Workflow.CoalesceWindow, func() { flushUpdate(groupKey) })
+		pendingUpdates[groupKey] = failed
+		return
+	}
+	for k, v := range failed.incidentUpdateParam {
+		if _, ok := pending.incidentUpdateParam[k]; !ok {
+			pending.incidentUpdateParam[k] = v
+		}
+	}
+	if failed.action == "reopen" {
+		pending.action = failed.action
+	}
+}
+
+// flushUpdates sends every pending update, on shutdown
+func flushUpdates() {
+	pendingUpdatesMutex.Lock()
+	groupKeys := make([]string, 0, len(pendingUpdates))
+	for groupKey := range pendingUpdates {
+		groupKeys = append(groupKeys, groupKey)
+	}
+	pendingUpdatesMutex.Unlock()
+
+	for _, groupKey := range groupKeys {
+		flushUpdate(groupKey)
+	}
+}
+
+// isReopened reports whether a firing alert group updates an incident in the resolved state set by close_fields,
+// which happens when this state is not in no_update_states
+func isReopened(incident Incident, data template.Data) bool {
+	if len(config.Workflow.ReopenState) == 0 && len(config.Workflow.ReopenComment) == 0 {
+		return false
+	}
+	return isAlreadyResolved(incident, closeFields(data))
+}
+
+// reopen sets the reopen_state and reopen_comment on the update of a reopened incident, instead of the regular update comment
+func reopen(incidentUpdateParam Incident, data template.Data) {
+	if len(config.Workflow.ReopenState) > 0 {
+		incidentUpdateParam["state"] = config.Workflow.ReopenState.String()
+	}
+	if len(config.Workflow.ReopenComment) > 0 {
+		comment, err := applyTemplate("reopen_comment", config.Workflow.ReopenComment, newTemplateData(data))
+		if err != nil {
+			webhookIncidentTemplateError.Inc()
+			log.Errorf("Error applying reopen_comment template: %v", err)
+			return
+		}
+		incidentUpdateParam["comments"] = comment
+	}
+}
+
+// oldestFiringStartsAt returns the start time of the oldest firing alert of the group
+func oldestFiringStartsAt(data template.Data) time.Time {
+	var oldest time.Time
+	for _, alert := range data.Alerts.Firing() {
+		if oldest.IsZero() || alert.StartsAt.Before(oldest) {
+			oldest = alert.StartsAt
+		}
+	}
+	return oldest
+}
+
+type firingCount struct {
+	count   int
+	expires time.Time
+}
+
+// firingCountDropped records the number of firing alerts of an alert group, and reports whether it dropped since the last notification.
+// Counts not refreshed within the firingCountTTL are evicted, so that alert groups never resolved do not pile up.
+func firingCountDropped(groupKey string, count int) bool {
+	firingCountsMutex.Lock()
+	defer firingCountsMutex.Unlock()
+
+	current := now()
+	for key, entry := range firingCounts {
+		if !current.Before(entry.expires) {
+			delete(firingCounts, key)
+		}
+	}
+	previous, ok := firingCounts[groupKey]
+	firingCounts[groupKey] = firingCount{count: count, expires: current.Add(firingCountTTL)}
+	return ok && count < previous.count
+}
+
+// forgetFiringCount removes the number of firing alerts recorded for a resolved alert group
+func forgetFiringCount(groupKey string) {
+	firingCountsMutex.Lock()
+	defer firingCountsMutex.Unlock()
+
+	delete(firingCounts, groupKey)
+}
+
+// updateAllowed reports whether the incident of an alert group key was not updated within the min_update_interval
+func updateAllowed(groupKey string) bool {
+	lastUpdatesMutex.Lock()
+	defer lastUpdatesMutex.Unlock()
+
+	last, ok := lastUpdates[groupKey]
+	return !ok || now().Sub(last) >= config.Workflow.MinUpdateInterval
+}
+
+// recordUpdate records the time of a firing update, and evicts the entries older than the min_update_interval
+func recordUpdate(groupKey string) {
+	lastUpdatesMutex.Lock()
+	defer lastUpdatesMutex.Unlock()
+
+	current := now()
+	for key, last := range lastUpdates {
+		if current.Sub(last) >= config.Workflow.MinUpdateInterval {
+			delete(lastUpdates, key)
+		}
+	}
+	lastUpdates[groupKey] = current
+}
+
+// forgetUpdate removes the time of the last firing update recorded for a resolved alert group
+func forgetUpdate(groupKey string) {
+	lastUpdatesMutex.Lock()
+	defer lastUpdatesMutex.Unlock()
+
+	delete(lastUpdates, groupKey)
+}
+
+// deescalate lowers the impact and urgency of the updated incident to the configured values.
+// A value is only applied when it is lower than the existing one (i.e.: a higher number), so that this never escalates the incident.
+func deescalate(incidentUpdateParam Incident, existing Incident) {
+	fields := map[string]string{
+		"impact":  config.Workflow.DeescalateOnPartialResolve.Impact,
+		"urgency": config.Workflow.DeescalateOnPartialResolve.Urgency,
+	}
+	for field, value := range fields {
+		target, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		existingValue, _ := existing[field].(string)
+		if current, err := strconv.Atoi(existingValue); err == nil && target <= current {
+			continue
+		}
+		log.Infof("De-escalating incident %s: %s set to %s", existing.GetNumber(), field, value)
+		incidentUpdateParam[field] = value
+	}
+}
+
+// idempotencyKey returns the group key suffixed with the current time bucket
+func idempotencyKey(groupKey string) string {
+	window := config.Workflow.IdempotencyWindow
+	if window <= 0 {
+		window = defaultIdempotencyWindow
 	}
+	return fmt.Sprintf("%s-%d", groupKey, now().UnixNano()/int64(window))
+}
 
-	// Load internal incidents update fields from config
-	incidentUpdateFields = make(map[string]bool, len(config.Workflow.IncidentUpdateFields))
-	for _, f := range config.Workflow.IncidentUpdateFields {
-		incidentUpdateFields[f] = true
+// checkNumberPrefix warns when the number of a created incident does not start with the expected prefix,
+// which often means that the incident was created in the wrong table
+func checkNumberPrefix(incident Incident) bool {
+	prefix := config.Workflow.ExpectedNumberPrefix
+	if len(prefix) == 0 || strings.HasPrefix(incident.GetNumber(), prefix) {
+		return true
 	}
-	log.Info("ServiceNow config loaded")
-	return config, nil
+	serviceNowUnexpectedNumberPrefix.Inc()
+	log.Warnf("Created incident number %s does not start with the expected prefix %s, please check the ServiceNow table", incident.GetNumber(), prefix)
+	return false
 }
 
-func loadConfig(configFile string) (Config, error) {
-	// Load the config from the file
-	configData, err := ioutil.ReadFile(configFile)
+// recoverSysID handles a created incident returned without sys_id (e.g. because of ACLs),
+// trying to find it back by its number.
+func recoverSysID(incident Incident, table string) {
+	serviceNowIncidentMissingSysID.Inc()
+	number := incident.GetNumber()
+	if len(number) == 0 {
+		log.Warn("Created incident has no sys_id nor number in ServiceNow response, please check the integration user ACLs")
+		return
+	}
+
+	log.Warnf("Created incident %s has no sys_id in ServiceNow response, trying to retrieve it by number", number)
+	incidents, err := getIncidentsIn(map[string]string{"number": number}, table)
 	if err != nil {
-		return Config{}, err
+		log.Warnf("Unable to retrieve sys_id of incident %s: %v", number, err)
+		return
+	}
+	if len(incidents) == 0 || len(incidents[0].GetSysID()) == 0 {
+		log.Warnf("Unable to retrieve sys_id of incident %s, please check the integration user ACLs", number)
+		return
 	}
 
-	return loadConfigContent(configData)
+	incident["sys_id"] = incidents[0].GetSysID()
+	log.Infof("Retrieved sys_id %s of incident %s", incident.GetSysID(), number)
 }
 
-func loadEnvVars(c *Config) {
-	if instanceName, ok := os.LookupEnv("SERVICENOW_INSTANCE_NAME"); ok {
-		(*c).ServiceNow.InstanceName = instanceName
-	}
-	if userName, ok := os.LookupEnv("SERVICENOW_USERNAME"); ok {
-		(*c).ServiceNow.UserName = userName
+// dedupWorkNotes removes the work note from the update when it is identical to the latest one of the incident
+func dedupWorkNotes(incidentUpdateParam Incident, incident Incident) {
+	workNotes, ok := incidentUpdateParam["work_notes"].(string)
+	if !ok || len(workNotes) == 0 {
+		return
 	}
-	if password, ok := os.LookupEnv("SERVICENOW_PASSWORD"); ok {
-		(*c).ServiceNow.Password = password
+
+	latest, err := serviceNow.GetLatestJournalEntry(incident.GetSysID(), "work_notes")
+	if err != nil {
+		log.Warnf("Unable to get latest work note of incident %s, work note will be added: %v", incident.GetNumber(), err)
+		return
 	}
-	if incidentField, ok := os.LookupEnv("SERVICENOW_INCIDENT_GROUP_KEY_FIELD"); ok {
-		(*c).Workflow.IncidentGroupKeyField = incidentField
+	if latest == workNotes {
+		log.Infof("Work note is identical to the latest one of incident %s, it will not be added", incident.GetNumber())
+		delete(incidentUpdateParam, "work_notes")
 	}
 }
 
-func loadSnClient() (ServiceNow, error) {
-	var err error
-	serviceNow, err = NewServiceNowClient(config.ServiceNow.InstanceName, config.ServiceNow.UserName, config.ServiceNow.Password)
-	if err != nil {
-		return serviceNow, err
+// skipDuplicateComments removes the comment from the update when it is identical to the comments of the existing incident
+func skipDuplicateComments(incidentUpdateParam Incident, incident Incident) {
+	comments, ok := incidentUpdateParam["comments"].(string)
+	if !ok || len(comments) == 0 {
+		return
+	}
+	if existing, _ := incident["comments"].(string); existing == comments {
+		log.Infof("Comment is identical to the one of incident %s, it will not be added", incident.GetNumber())
+		delete(incidentUpdateParam, "comments")
 	}
-	return serviceNow, nil
 }
 
-func onAlertGroup(data template.Data) error {
-
-	log.Infof("Received alert group: Status=%s, GroupLabels=%v, CommonLabels=%v, CommonAnnotations=%v",
-		data.Status, data.GroupLabels, data.CommonLabels, data.CommonAnnotations)
-
-	getParams := map[string]string{
-		config.Workflow.IncidentGroupKeyField: getGroupKey(data),
+// nextUpdateCount returns the incremented update count of an existing incident.
+// A missing or non numeric count is reset to 1.
+func nextUpdateCount(incident Incident) string {
+	value, _ := incident[config.Workflow.UpdateCountField].(string)
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return "1"
 	}
+	return strconv.Itoa(count + 1)
+}
 
-	existingIncidents, err := serviceNow.GetIncidents(getParams)
+// escalate reassigns the updated incident when its update count reaches the threshold of an escalation rule.
+// As the count is incremented by one on each firing update, a threshold is only reached once.
+func escalate(incidentUpdateParam Incident, existing Incident) {
+	count, err := strconv.Atoi(nextUpdateCount(existing))
 	if err != nil {
-		serviceNowError.Inc()
-		return err
+		return
 	}
-	log.Infof("Found %v existing incident(s) for alert group key: %s.", len(existingIncidents), getGroupKey(data))
-
-	updatableIncidents := filterUpdatableIncidents(existingIncidents)
-	log.Infof("Found %v updatable incident(s) for alert group key: %s.", len(updatableIncidents), getGroupKey(data))
-
-	var updatableIncident Incident
-	if len(updatableIncidents) > 0 {
-		updatableIncident = updatableIncidents[0]
-
-		if len(updatableIncidents) > 1 {
-			log.Warnf("As multiple updable incidents were found for alert group key: %s, first one will be used: %s", getGroupKey(data), updatableIncident.GetNumber())
+	for _, rule := range config.Workflow.Escalation {
+		if rule.UpdateCount == count {
+			log.Infof("Escalating incident %s to assignment group %s after %d firing updates", existing.GetNumber(), rule.AssignmentGroup, count)
+			incidentUpdateParam["assignment_group"] = rule.AssignmentGroup
 		}
 	}
-
-	if data.Status == "firing" {
-		return onFiringGroup(data, updatableIncident)
-	} else if data.Status == "resolved" {
-		return onResolvedGroup(data, updatableIncident)
-	} else {
-		log.Errorf("Unknown alert group status: %s", data.Status)
-	}
-
-	return nil
 }
 
-func onFiringGroup(data template.Data, updatableIncident Incident) error {
-	incidentCreateParam, err := alertGroupToIncident(data)
+func onResolvedGroup(data template.Data, groupKey string, updatableIncidents []Incident) error {
+	flushUpdate(groupKey)
+	forgetFiringCount(groupKey)
+	forgetUpdate(groupKey)
+
+	incidentCreateParam, err := groupKeyIncident(data, groupKey, nil)
 	if err != nil {
 		return err
 	}
 
 	incidentUpdateParam := filterForUpdate(incidentCreateParam)
+	if len(config.Workflow.ResolveComment) > 0 {
+		field := config.Workflow.ResolveCommentField
+		if len(field) == 0 {
+			field = defaultResolveCommentField
+		}
+		comment, err := applyTemplate("resolve_comment", config.Workflow.ResolveComment, newTemplateData(data))
+		if err != nil {
+			webhookIncidentTemplateError.Inc()
+			log.Errorf("Error applying resolve_comment template: %v", err)
+		} else {
+			incidentUpdateParam[field] = comment
+		}
+	}
 
-	if updatableIncident == nil {
-		log.Infof("Found no updatable incident for firing alert group key: %s", getGroupKey(data))
-		if _, err := serviceNow.CreateIncident(incidentCreateParam); err != nil {
-			serviceNowError.Inc()
-			return err
+	if len(updatableIncidents) == 0 {
+		sampledInfof("Found no updatable incident for resolved alert group key: %s. No incident will be created/updated.", groupKey)
+		return nil
+	}
+
+	if config.Workflow.CloseOnFullResolve {
+		if firing := len(data.Alerts.Firing()); firing > 0 {
+			log.Infof("%d alert(s) still firing for resolved alert group key: %s, incident will be updated but not closed", firing, groupKey)
+		} else {
+			fields := closeFields(data)
+			if isCancelled(data) {
+				log.Infof("Resolved alert group key: %s has the %s label, incident will be cancelled", groupKey, config.Workflow.CancelLabel)
+				fields = cancelFields(data)
+			}
+			for k, v := range fields {
+				incidentUpdateParam[k] = v
+			}
 		}
-	} else {
-		log.Infof("Found updatable incident (%s), with state %s, for firing alert group key: %s", updatableIncident.GetNumber(), updatableIncident.GetState(), getGroupKey(data))
-		if _, err := serviceNow.UpdateIncident(incidentUpdateParam, updatableIncident.GetSysID()); err != nil {
+	}
+
+	// Update every incident, even if one of them fails
+	var errs []string
+	for _, updatableIncident := range updatableIncidents {
+		sampledInfof("Found updatable incident (%s), with state %s, for resolved alert group key: %s", updatableIncident.GetNumber(), updatableIncident.GetState(), groupKey)
+		if isAlreadyResolved(updatableIncident, incidentUpdateParam) {
+			webhookResolveDeduped.Inc()
+			log.Infof("Incident %s is already in the resolved state %s, it will not be updated again", updatableIncident.GetNumber(), updatableIncident.GetState())
+			continue
+		}
+		_, err := updateIncidentIn(incidentUpdateParam, updatableIncident.GetSysID(), incidentTable(data))
+		audit("resolve", groupKey, updatableIncident, config.ServiceNow.UserName, err)
+		if err != nil {
 			serviceNowError.Inc()
-			return err
+			errs = append(errs, err.Error())
 		}
 	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
 	return nil
 }
 
-func onResolvedGroup(data template.Data, updatableIncident Incident) error {
-	incidentCreateParam, err := alertGroupToIncident(data)
-	if err != nil {
-		return err
-	}
+// isAlreadyResolved reports whether the incident is already in the state set by the resolve update, as on a repeated resolved notification
+func isAlreadyResolved(incident Incident, incidentUpdateParam Incident) bool {
+	target, _ := incidentUpdateParam["state"].(string)
+	return len(target) > 0 && normalizeState(json.Number(target)) == normalizeState(incident.GetState())
+}
 
-	incidentUpdateParam := filterForUpdate(incidentCreateParam)
+// closeFields returns the templated fields sent to close the incidents of a resolved alert group
+func closeFields(data template.Data) Incident {
+	return resolutionFields(config.Workflow.CloseFields, data)
+}
 
-	if updatableIncident == nil {
-		log.Infof("Found no updatable incident for resolved alert group key: %s. No incident will be created/updated.", getGroupKey(data))
-	} else {
-		log.Infof("Found updatable incident (%s), with state %s, for resolved alert group key: %s", updatableIncident.GetNumber(), updatableIncident.GetState(), getGroupKey(data))
-		if _, err := serviceNow.UpdateIncident(incidentUpdateParam, updatableIncident.GetSysID()); err != nil {
-			serviceNowError.Inc()
-			return err
+// cancelFields returns the templated fields sent to cancel the incidents of a resolved alert group, instead of the close fields
+func cancelFields(data template.Data) Incident {
+	return resolutionFields(config.Workflow.CancelFields, data)
+}
+
+// isCancelled reports whether a resolved alert group carries the cancel_label, e.g. as a false positive
+func isCancelled(data template.Data) bool {
+	return len(config.Workflow.CancelLabel) > 0 && len(data.CommonLabels[config.Workflow.CancelLabel]) > 0
+}
+
+// resolutionFields templates the fields sent to close or cancel incidents.
+// A field whose template fails is left out. The resolved_by and closed_by fields, required by ServiceNow to close an incident,
+// default to the integration user when they are not configured or empty, and are left out when no user is known.
+func resolutionFields(templates map[string]string, data template.Data) Incident {
+	fields := Incident{}
+	for k, v := range templates {
+		value, err := applyTemplate(k, v, newTemplateData(data))
+		if err != nil {
+			log.Errorf("Error applying close field template %s: %v", k, err)
+			continue
 		}
+		fields[k] = value
 	}
-	return nil
+	for _, field := range []string{"resolved_by", "closed_by"} {
+		if value, _ := fields[field].(string); len(value) > 0 {
+			continue
+		}
+		if len(config.ServiceNow.UserName) > 0 {
+			fields[field] = config.ServiceNow.UserName
+		} else {
+			delete(fields, field)
+		}
+	}
+	return fields
+}
+
+// alertGroupToIncident builds the incident of an alert group.
+// The existing incident, if any, is available in templates as .Existing
+func alertGroupToIncident(data template.Data, existing Incident) (Incident, error) {
+	return groupKeyIncident(data, getGroupKey(data), existing)
 }
 
-func alertGroupToIncident(data template.Data) (Incident, error) {
+// groupKeyIncident builds the incident of an alert group whose group key is already rendered
+func groupKeyIncident(data template.Data, groupKey string, existing Incident) (Incident, error) {
 
 	incident := Incident{
-		"caller_id":                           config.ServiceNow.UserName,
-		config.Workflow.IncidentGroupKeyField: getGroupKey(data),
+		"caller_id": config.ServiceNow.UserName,
 	}
 
 	for k, v := range config.DefaultIncident {
 		incident[k] = v
 	}
 
-	applyIncidentTemplate(incident, data)
+	templateData := newTemplateData(data)
+	templateData.Existing = existing
+	applyIncidentTemplate(incident, templateData)
+	// The group key and label values are set after templating, so that they are never executed as templates
+	incident[config.Workflow.IncidentGroupKeyField] = groupKey
+	for field, label := range config.Workflow.FieldFromLabel {
+		if value, ok := data.CommonLabels[label]; ok {
+			incident[field] = value
+		}
+	}
+	for label, field := range config.Workflow.GroupLabelFields {
+		if value, ok := data.GroupLabels[label]; ok {
+			incident[field] = value
+		}
+	}
+	applyAssignmentGroupOrder(incident, data)
+	if category, _ := incident["category"].(string); len(category) == 0 {
+		if category := categoryFromAlertname(data); len(category) > 0 {
+			incident["category"] = category
+		}
+	}
+	applyTransforms(incident)
+	if annotation := config.Workflow.DefaultShortDescriptionAnnotation; len(annotation) > 0 {
+		if _, ok := incident["short_description"]; !ok {
+			incident["short_description"] = defaultShortDescription
+			if summary := data.CommonAnnotations[annotation]; len(summary) > 0 {
+				incident["short_description"] = summary
+			}
+		}
+	}
+	formatShortDescription(incident)
+
+	if len(config.Workflow.SourceLinkField) > 0 {
+		incident[config.Workflow.SourceLinkField] = generatorURL(data.Alerts)
+	}
+	if len(config.Workflow.AlertNamesField) > 0 {
+		incident[config.Workflow.AlertNamesField] = alertNames(data.Alerts)
+	}
+	if len(config.Workflow.PrometheusField) > 0 && len(templateData.Prometheus) > 0 {
+		incident[config.Workflow.PrometheusField] = templateData.Prometheus
+	}
+	if len(config.Workflow.RunbookField) > 0 {
+		incident[config.Workflow.RunbookField] = templateData.RunbookURL
+	}
+	if len(config.Workflow.AffectedField) > 0 {
+		incident[config.Workflow.AffectedField] = templateData.AffectedCIs
+	}
+	if len(config.Workflow.WebhookVersionField) > 0 {
+		// Only sent on create, unless the field is in incident_update_fields
+		incident[config.Workflow.WebhookVersionField] = templateData.WebhookVersion
+	}
+	if len(config.Workflow.GroupFingerprintField) > 0 {
+		incident[config.Workflow.GroupFingerprintField] = templateData.GroupFingerprint
+	}
+	if len(config.Workflow.ShortKeyField) > 0 {
+		incident[config.Workflow.ShortKeyField] = shortGroupKey(groupKey)
+	}
+	if len(config.Workflow.AlertCountField) > 0 {
+		// A json.Number is sent as a JSON number, unlike the templated fields
+		incident[config.Workflow.AlertCountField] = json.Number(strconv.Itoa(len(data.Alerts.Firing())))
+	}
+
+	if config.Workflow.ComputePriority {
+		computePriority(incident)
+	}
+
 	err := validateIncident(incident)
 	if err != nil {
 		webhookIncidentValidationError.Inc()
@@ -398,10 +2728,160 @@ func alertGroupToIncident(data template.Data) (Incident, error) {
 	return incident, nil
 }
 
+// categoryFromAlertname returns the category_from_alertname_prefix category of the longest prefix of the common alertname,
+// or of the alertname of the first alert, or an empty string when no prefix matches
+func categoryFromAlertname(data template.Data) string {
+	alertname := data.CommonLabels["alertname"]
+	if len(alertname) == 0 && len(data.Alerts) > 0 {
+		alertname = data.Alerts[0].Labels["alertname"]
+	}
+	var category, longest string
+	for prefix, value := range config.Workflow.CategoryFromAlertnamePrefix {
+		if strings.HasPrefix(alertname, prefix) && len(prefix) > len(longest) {
+			category, longest = value, prefix
+		}
+	}
+	return category
+}
+
+// applyAssignmentGroupOrder sets the assignment_group to the first non-empty value of the assignment_group_order sources.
+// The assignment_group is left untouched when every source is empty.
+func applyAssignmentGroupOrder(incident Incident, data template.Data) {
+	for _, source := range config.Workflow.AssignmentGroupOrder {
+		// Sources are validated when the config is loaded
+		if group, _ := assignmentGroupFrom(source, data); len(group) > 0 {
+			incident["assignment_group"] = group
+			return
+		}
+	}
+}
+
+// assignmentGroupFrom returns the assignment group of an alert group from one source:
+// label:<label>, lookup:<table>[:<label>] (the label defaults to the table name) or static:<value>
+func assignmentGroupFrom(source string, data template.Data) (string, error) {
+	parts := strings.SplitN(source, ":", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return "", fmt.Errorf("invalid source %q, expected label:<label>, lookup:<table>[:<label>] or static:<value>", source)
+	}
+	switch parts[0] {
+	case "label":
+		return data.CommonLabels[parts[1]], nil
+	case "lookup":
+		args := strings.SplitN(parts[1], ":", 2)
+		label := args[0]
+		if len(args) == 2 {
+			label = args[1]
+		}
+		return lookup(args[0], data.CommonLabels[label]), nil
+	case "static":
+		return parts[1], nil
+	default:
+		return "", fmt.Errorf("unknown source %q, expected label, lookup or static", parts[0])
+	}
+}
+
+// formatShortDescription adds the configured prefix and suffix to the templated short_description, and truncates it to the maximum length.
+// Only the templated text is truncated, so that the prefix and suffix are kept.
+// As the short_description is built from its template each time, the prefix and suffix are never applied twice.
+func formatShortDescription(incident Incident) {
+	w := config.Workflow
+	if w.IncidentGroupKeyField == "short_description" {
+		return
+	}
+	shortDescription, ok := incident["short_description"].(string)
+	if !ok {
+		return
+	}
+
+	text := []rune(shortDescription)
+	if w.ShortDescriptionMaxLength > 0 {
+		available := w.ShortDescriptionMaxLength - len([]rune(w.ShortDescriptionPrefix)) - len([]rune(w.ShortDescriptionSuffix))
+		if available < 0 {
+			available = 0
+		}
+		if len(text) > available {
+			text = text[:available]
+		}
+	}
+	incident["short_description"] = w.ShortDescriptionPrefix + string(text) + w.ShortDescriptionSuffix
+}
+
+// applyTransforms applies the configured transforms, in order, to the templated incident fields
+func applyTransforms(incident Incident) {
+	for field, transforms := range config.Workflow.Transforms {
+		value, ok := incident[field].(string)
+		if !ok {
+			continue
+		}
+		for _, transform := range transforms {
+			// Transforms are validated when the config is loaded
+			value, _ = applyTransform(value, transform)
+		}
+		incident[field] = value
+	}
+}
+
+// applyTransform applies one transform to a value:
+// lower, upper, trim, replace:<old>:<new> or map:<from>=<to>[,<from>=<to>...] (values without mapping are left untouched)
+func applyTransform(value string, transform string) (string, error) {
+	op := strings.SplitN(transform, ":", 2)
+	switch op[0] {
+	case "lower":
+		return strings.ToLower(value), nil
+	case "upper":
+		return strings.ToUpper(value), nil
+	case "trim":
+		return strings.TrimSpace(value), nil
+	case "replace":
+		if len(op) < 2 || !strings.Contains(op[1], ":") {
+			return value, fmt.Errorf("invalid transform %s, expected replace:<old>:<new>", transform)
+		}
+		args := strings.SplitN(op[1], ":", 2)
+		return strings.Replace(value, args[0], args[1], -1), nil
+	case "map":
+		if len(op) < 2 {
+			return value, fmt.Errorf("invalid transform %s, expected map:<from>=<to>", transform)
+		}
+		mapped := value
+		for _, pair := range strings.Split(op[1], ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return value, fmt.Errorf("invalid transform %s, expected map:<from>=<to>", transform)
+			}
+			if kv[0] == value {
+				mapped = kv[1]
+			}
+		}
+		return mapped, nil
+	}
+	return value, fmt.Errorf("unknown transform %s", transform)
+}
+
+// computePriority sets the incident priority from its impact and urgency, using the ServiceNow default priority matrix.
+// An explicitly provided priority is left untouched.
+func computePriority(incident Incident) {
+	if priority, ok := incident["priority"].(string); ok && len(priority) > 0 {
+		return
+	}
+
+	impactValue, _ := incident["impact"].(string)
+	urgencyValue, _ := incident["urgency"].(string)
+	impact, err := strconv.Atoi(impactValue)
+	if err != nil || impact < 1 || impact > len(priorityMatrix) {
+		return
+	}
+	urgency, err := strconv.Atoi(urgencyValue)
+	if err != nil || urgency < 1 || urgency > len(priorityMatrix[0]) {
+		return
+	}
+
+	incident["priority"] = priorityMatrix[impact-1][urgency-1]
+}
+
 func filterForUpdate(incident Incident) Incident {
 	incidentUpdate := Incident{}
 	for field, value := range incident {
-		if incidentUpdateFields[field] {
+		if incidentUpdateFields[field] && !createOnlyFields[field] {
 			incidentUpdate[field] = value
 		}
 	}
@@ -411,37 +2891,277 @@ func filterForUpdate(incident Incident) Incident {
 func filterUpdatableIncidents(incidents []Incident) []Incident {
 	var updatableIncidents []Incident
 	for _, incident := range incidents {
-		if !noUpdateStates[incident.GetState()] {
+		state := normalizeState(incident.GetState())
+		if len(updatableStates) > 0 {
+			if updatableStates[state] {
+				updatableIncidents = append(updatableIncidents, incident)
+			}
+		} else if !noUpdateStates[state] {
 			updatableIncidents = append(updatableIncidents, incident)
 		}
 	}
 	return updatableIncidents
 }
 
+// normalizeState returns the canonical form of an incident state, so that configured and returned states compare
+// equal whatever their representation (e.g.: 6, "6", " 6" or 6.0). Non numeric states (display labels) are only trimmed.
+func normalizeState(state json.Number) string {
+	value := strings.TrimSpace(state.String())
+	if f, err := strconv.ParseFloat(value, 64); err == nil && f == float64(int64(f)) {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return value
+}
+
+// getGroupKey returns the value identifying the incident of an alert group: the rendered incident_group_key_value template when configured,
+// or a hash of the group labels. The same value is used to create incidents and to match the existing ones.
 func getGroupKey(data template.Data) string {
-	hash := md5.Sum([]byte(fmt.Sprintf("%v", data.GroupLabels.SortedPairs())))
+	if text := config.Workflow.IncidentGroupKeyValue; len(text) > 0 {
+		value, err := applyTemplate("incident_group_key_value", text, newTemplateData(data))
+		switch {
+		case err != nil:
+			log.Warnf("Error rendering incident_group_key_value, the group labels hash is used instead: %v", err)
+		case len(strings.TrimSpace(value)) == 0 || strings.Contains(value, "<no value>"):
+			log.Warnf("incident_group_key_value rendered an empty value, the group labels hash is used instead")
+		case strings.Contains(value, "^"):
+			// A ^ would alter the encoded query searching the incidents of the group key
+			log.Warnf("incident_group_key_value rendered a value containing ^, the group labels hash is used instead")
+		default:
+			return value
+		}
+	}
+	return groupLabelsHash(data)
+}
+
+// groupFingerprint returns the fingerprint of the group labels, as computed by Alertmanager for the alert group.
+// Unlike the group key, it ignores group_key_discriminator_label and incident_group_key_value.
+func groupFingerprint(data template.Data) string {
+	labels := make(model.LabelSet, len(data.GroupLabels))
+	for k, v := range data.GroupLabels {
+		labels[model.LabelName(k)] = model.LabelValue(v)
+	}
+	return labels.Fingerprint().String()
+}
+
+// shortGroupKey returns the first characters of the group key, a human-readable dedup hash for reporting.
+// It is not used to match incidents, the full group key is.
+func shortGroupKey(groupKey string) string {
+	if len(groupKey) <= shortGroupKeyLength {
+		return groupKey
+	}
+	return groupKey[:shortGroupKeyLength]
+}
+
+func groupLabelsHash(data template.Data) string {
+	key := canonicalLabels(data.GroupLabels)
+	if label := config.Workflow.GroupKeyDiscriminatorLabel; len(label) > 0 {
+		key += fmt.Sprintf("{%s %s}", label, data.CommonLabels[label])
+	}
+	hash := md5.Sum([]byte(key))
 	return fmt.Sprintf("%x", hash)
 }
 
-func applyIncidentTemplate(incident Incident, data template.Data) {
+func newTemplateData(data template.Data) TemplateData {
+	prometheus := sourcePrometheus(data)
+	affected := affectedCIs(data.Alerts)
+	fingerprint := groupFingerprint(data)
+	data = stripLabels(data)
+	templateData := TemplateData{
+		Data:             data,
+		FiringAlerts:     data.Alerts.Firing(),
+		ResolvedAlerts:   data.Alerts.Resolved(),
+		AlertNames:       alertNames(data.Alerts),
+		Prometheus:       prometheus,
+		RunbookURL:       runbookURL(data),
+		AffectedCIs:      affected,
+		AlertCount:       len(data.Alerts),
+		GroupFingerprint: fingerprint,
+		WebhookVersion:   version.Version,
+	}
+	if max := config.Workflow.MaxAlertsInDescription; max > 0 && len(data.Alerts) > max {
+		templateData.Alerts = sortedAlerts(data.Alerts)[:max]
+		templateData.MoreAlerts = moreAlerts(len(data.Alerts) - max)
+	}
+	return templateData
+}
+
+// sortedAlerts returns a copy of the alerts sorted by start time, then by labels, so that truncated lists are stable between notifications
+func sortedAlerts(alerts template.Alerts) template.Alerts {
+	sorted := make(template.Alerts, len(alerts))
+	copy(sorted, alerts)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].StartsAt.Equal(sorted[j].StartsAt) {
+			return sorted[i].StartsAt.Before(sorted[j].StartsAt)
+		}
+		return canonicalLabels(sorted[i].Labels) < canonicalLabels(sorted[j].Labels)
+	})
+	return sorted
+}
+
+// moreAlerts returns the note appended to a truncated alert list
+func moreAlerts(count int) string {
+	return fmt.Sprintf("...and %d more", count)
+}
+
+// runbookURL returns the runbook_url annotation of the first alert, or an empty string when missing
+func runbookURL(data template.Data) string {
+	if len(data.Alerts) == 0 {
+		return ""
+	}
+	return data.Alerts[0].Annotations[runbookAnnotation]
+}
+
+// sourcePrometheus returns the Prometheus label (by default "prometheus") of the first alert, or an empty string when missing
+func sourcePrometheus(data template.Data) string {
+	if len(data.Alerts) == 0 {
+		return ""
+	}
+	label := config.Workflow.PrometheusLabel
+	if len(label) == 0 {
+		label = defaultPrometheusLabel
+	}
+	return data.Alerts[0].Labels[label]
+}
+
+// stripLabels returns a copy of the alert group without the internal labels (prefixed by "__"), unless disabled,
+// and without the labels of the deny list, so that they do not clutter the templated fields
+func stripLabels(data template.Data) template.Data {
+	stripInternal := config.Workflow.StripInternalLabels == nil || *config.Workflow.StripInternalLabels
+	if !stripInternal && len(config.Workflow.LabelDenyList) == 0 {
+		return data
+	}
+
+	strip := func(labels template.KV) template.KV {
+		stripped := make(template.KV, len(labels))
+		for k, v := range labels {
+			if (stripInternal && strings.HasPrefix(k, "__")) || contains(config.Workflow.LabelDenyList, k) {
+				continue
+			}
+			stripped[k] = v
+		}
+		return stripped
+	}
+
+	data.GroupLabels = strip(data.GroupLabels)
+	data.CommonLabels = strip(data.CommonLabels)
+	alerts := make(template.Alerts, len(data.Alerts))
+	for i, alert := range data.Alerts {
+		alert.Labels = strip(alert.Labels)
+		alerts[i] = alert
+	}
+	data.Alerts = alerts
+	return data
+}
+
+// alertNames returns the sorted and deduplicated alertname labels of the alerts, joined by commas
+func alertNames(alerts template.Alerts) string {
+	return strings.Join(labelValues(alerts, "alertname"), ", ")
+}
+
+// affectedCIs returns the sorted and deduplicated affected_label (by default "instance") labels of the alerts, joined by commas.
+// The list is capped to maxAffectedCIsLength characters, the values left out being counted: "a, b (+3 more)".
+func affectedCIs(alerts template.Alerts) string {
+	label := config.Workflow.AffectedLabel
+	if len(label) == 0 {
+		label = defaultAffectedLabel
+	}
+	values := labelValues(alerts, label)
+
+	var result string
+	for i, value := range values {
+		next := value
+		if i > 0 {
+			next = result + ", " + value
+		}
+		// Unless this is the last value, keep room for the count of the values left out
+		length := len(next)
+		if i < len(values)-1 {
+			length += len(moreValues(len(values) - i))
+		}
+		if length > maxAffectedCIsLength {
+			return result + moreValues(len(values)-i)
+		}
+		result = next
+	}
+	return result
+}
+
+func moreValues(count int) string {
+	return fmt.Sprintf(" (+%d more)", count)
+}
+
+// labelValues returns the sorted and deduplicated non-empty values of a label of the alerts
+func labelValues(alerts template.Alerts, label string) []string {
+	seen := make(map[string]bool)
+	for _, alert := range alerts {
+		if value := alert.Labels[label]; len(value) > 0 {
+			seen[value] = true
+		}
+	}
+
+	values := make([]string, 0, len(seen))
+	for value := range seen {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// canonicalLabels returns a stable string representation of the labels, independent of the map iteration order.
+// The alertname label comes first, then the other labels sorted by name: "[{alertname a} {env b} {instance c}]".
+// This format must not change as it is used to compute the group key of existing incidents.
+func canonicalLabels(labels template.KV) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if name != "alertname" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := labels["alertname"]; ok {
+		names = append([]string{"alertname"}, names...)
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("{%s %s}", name, labels[name])
+	}
+	return "[" + strings.Join(pairs, " ") + "]"
+}
+
+func applyIncidentTemplate(incident Incident, templateData TemplateData) {
 	for key, val := range incident {
 		var err error
-		incident[key], err = applyTemplate(key, val.(string), data)
+		if compiled, ok := incidentTemplates[key]; ok && val == compiled.text {
+			incident[key], err = executeTemplate(compiled.tmpl, templateData)
+		} else {
+			incident[key], err = applyTemplate(key, val.(string), templateData)
+		}
 		if err != nil {
 			webhookIncidentTemplateError.Inc()
 			log.Errorf("Error parsing default incident template for key:%s value:%s, error:%v", key, val.(string), err)
+			switch config.Workflow.OnTemplateError {
+			case onTemplateErrorKeep:
+				incident[key] = val
+			case onTemplateErrorSkip:
+				delete(incident, key)
+			}
 		}
 	}
 }
 
-func applyTemplate(name string, text string, data template.Data) (string, error) {
-	tmpl, err := tmpltext.New(name).Parse(text)
+func applyTemplate(name string, text string, data interface{}) (string, error) {
+	tmpl, err := tmpltext.New(name).Funcs(templateFuncs).Parse(text)
 	if err != nil {
 		return "", err
 	}
 
+	return executeTemplate(tmpl, data)
+}
+
+func executeTemplate(tmpl *tmpltext.Template, data interface{}) (string, error) {
 	var result bytes.Buffer
-	err = tmpl.Execute(&result, data)
+	err := tmpl.Execute(&result, data)
 	if err != nil {
 		return "", err
 	}
@@ -449,25 +3169,112 @@ func applyTemplate(name string, text string, data template.Data) (string, error)
 	return result.String(), nil
 }
 
+// compileIncidentTemplates parses the default incident templates once, so they are not parsed on every request.
+// Invalid templates are left out, their error is reported when applied.
+func compileIncidentTemplates(defaultIncident map[string]string) map[string]compiledTemplate {
+	templates := make(map[string]compiledTemplate, len(defaultIncident))
+	for key, text := range defaultIncident {
+		tmpl, err := tmpltext.New(key).Funcs(templateFuncs).Parse(text)
+		if err != nil {
+			continue
+		}
+		templates[key] = compiledTemplate{text: text, tmpl: tmpl}
+	}
+	return templates
+}
+
+// lintSampleData is a representative alert group, used to detect the default_incident templates referencing absent data
+var lintSampleData = template.Data{
+	Receiver: "servicenow",
+	Status:   "firing",
+	Alerts: template.Alerts{{
+		Status:       "firing",
+		Labels:       template.KV{"alertname": "SampleAlert", "severity": "critical", "instance": "server01:9100", "job": "node"},
+		Annotations:  template.KV{"summary": "Sample summary", "description": "Sample description"},
+		StartsAt:     time.Unix(0, 0),
+		GeneratorURL: "http://prometheus:9090/graph",
+	}},
+	GroupLabels:       template.KV{"alertname": "SampleAlert"},
+	CommonLabels:      template.KV{"alertname": "SampleAlert", "severity": "critical", "instance": "server01:9100", "job": "node"},
+	CommonAnnotations: template.KV{"summary": "Sample summary", "description": "Sample description"},
+	ExternalURL:       "http://alertmanager:9093",
+}
+
+// lintIncidentTemplates renders the default_incident templates against a sample alert group, and returns a warning
+// for each template failing or rendering "<no value>", which usually reveals a typo in a field or label name.
+// Labels and annotations missing from the sample are reported too, these warnings are not errors.
+func lintIncidentTemplates(templates map[string]compiledTemplate) []string {
+	keys := make([]string, 0, len(templates))
+	for key := range templates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var warnings []string
+	for _, key := range keys {
+		result, err := executeTemplate(templates[key].tmpl, newTemplateData(lintSampleData))
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("default_incident %s template fails on a sample alert group: %v", key, err))
+		} else if strings.Contains(result, "<no value>") {
+			warnings = append(warnings, fmt.Sprintf("default_incident %s template renders <no value> on a sample alert group, check the referenced fields: %s", key, templates[key].text))
+		}
+	}
+	return warnings
+}
+
+// generatorURL returns the GeneratorURL of the first alert, or an empty string if there is no alert
+func generatorURL(alerts template.Alerts) string {
+	if len(alerts) == 0 {
+		return ""
+	}
+	return alerts[0].GeneratorURL
+}
+
+// lookup returns the value mapped to the key in the given lookup table, or the optional default value
+func lookup(table string, key string, defaultValue ...string) string {
+	if value, ok := lookupTables[table][key]; ok {
+		return value
+	}
+	if len(defaultValue) > 0 {
+		return defaultValue[0]
+	}
+	return ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func validateIncident(incident Incident) error {
-	var str strings.Builder
-	if impact, ok := incident["impact"]; ok && impact != nil && len(impact.(string)) > 0 {
-		if _, err := strconv.Atoi(impact.(string)); err != nil {
-			str.WriteString("'impact' field value is ")
-			str.WriteString(impact.(string))
-			str.WriteString(" but should be an integer, please fix your configuration. Incident creation/update will proceed but this field will be missing. ")
+	var errs ValidationErrors
+	for _, field := range []string{"impact", "urgency"} {
+		if value, ok := incident[field].(string); ok && len(value) > 0 {
+			if _, err := strconv.Atoi(value); err != nil {
+				errs = append(errs, ValidationError{
+					Field:  field,
+					Value:  value,
+					Reason: "should be an integer, please fix your configuration. Incident creation/update will proceed but this field will be missing",
+				})
+			}
 		}
 	}
 
-	if urgency, ok := incident["urgency"]; ok && urgency != nil && len(urgency.(string)) > 0 {
-		if _, err := strconv.Atoi(urgency.(string)); err != nil {
-			str.WriteString("'urgency' field value is ")
-			str.WriteString(urgency.(string))
-			str.WriteString(" but should be an integer, please fix your configuration. Incident creation/update will proceed but this field will be missing.")
+	if category, ok := incident["category"].(string); ok && len(category) > 0 && len(config.Workflow.AllowedCategories) > 0 {
+		if !contains(config.Workflow.AllowedCategories, category) {
+			errs = append(errs, ValidationError{
+				Field:  "category",
+				Value:  category,
+				Reason: "should be one of " + strings.Join(config.Workflow.AllowedCategories, ", ") + ", please fix your configuration",
+			})
 		}
 	}
-	if str.Len() > 0 {
-		return errors.New(str.String())
+	if len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
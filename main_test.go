@@ -2,15 +2,32 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
 	"github.com/stretchr/testify/mock"
 )
 
@@ -23,26 +40,272 @@ func (mock *MockedSnClient) CreateIncident(incidentParam Incident) (Incident, er
 	return args.Get(0).(Incident), args.Error(1)
 }
 
+func (mock *MockedSnClient) CreateIncidentInTable(incidentParam Incident, table string) (Incident, error) {
+	args := mock.Called(incidentParam, table)
+	return args.Get(0).(Incident), args.Error(1)
+}
+
 func (mock *MockedSnClient) GetIncidents(params map[string]string) ([]Incident, error) {
 	args := mock.Called(params)
 	return args.Get(0).([]Incident), args.Error(1)
 }
 
+func (mock *MockedSnClient) GetIncidentsInTable(params map[string]string, table string) ([]Incident, error) {
+	args := mock.Called(params, table)
+	return args.Get(0).([]Incident), args.Error(1)
+}
+
+func (mock *MockedSnClient) GetIncidentByNumber(number string) (Incident, error) {
+	args := mock.Called(number)
+	return args.Get(0).(Incident), args.Error(1)
+}
+
 func (mock *MockedSnClient) UpdateIncident(incidentParam Incident, sysID string) (Incident, error) {
 	args := mock.Called(incidentParam, sysID)
 	return args.Get(0).(Incident), args.Error(1)
 }
 
+func (mock *MockedSnClient) UpdateIncidentInTable(incidentParam Incident, sysID string, table string) (Incident, error) {
+	args := mock.Called(incidentParam, sysID, table)
+	return args.Get(0).(Incident), args.Error(1)
+}
+
+func (mock *MockedSnClient) GetLatestJournalEntry(sysID string, element string) (string, error) {
+	args := mock.Called(sysID, element)
+	return args.String(0), args.Error(1)
+}
+
+func (mock *MockedSnClient) GetUserSysID(user string) (string, error) {
+	args := mock.Called(user)
+	return args.String(0), args.Error(1)
+}
+
+func (mock *MockedSnClient) CheckHealth() error {
+	args := mock.Called()
+	return args.Error(0)
+}
+
+// mockServiceNow sets up a mocked ServiceNow client finding the given incidents, on which incident creations and updates succeed
+func mockServiceNow(existing ...Incident) *MockedSnClient {
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return(append([]Incident{}, existing...), nil)
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{"number": "INC42", "sys_id": "42"}, nil)
+	snClientMock.On("UpdateIncident", mock.Anything, mock.Anything).Return(Incident{}, nil)
+	return snClientMock
+}
+
+// incidentsOf returns the incident argument of each call of a method, in order, whatever the calls of the other methods
+func (mock *MockedSnClient) incidentsOf(method string) []Incident {
+	var incidents []Incident
+	for _, call := range mock.Calls {
+		if call.Method == method {
+			incidents = append(incidents, call.Arguments.Get(0).(Incident))
+		}
+	}
+	return incidents
+}
+
 func TestLoadSnClient_OK(t *testing.T) {
-	loadConfig("config/servicenow_example.yml")
+	loadConfig("test/servicenow_test.yml")
 	_, err := loadSnClient()
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
+func TestLoadSnClient_BaseURL(t *testing.T) {
+	defer loadConfig("test/servicenow_test.yml")
+
+	tests := []struct {
+		name    string
+		domain  string
+		baseURL string
+		want    string
+	}{
+		{name: "default", want: "https://instance.service-now.com"},
+		{name: "domain", domain: "servicenowservices.com", want: "https://instance.servicenowservices.com"},
+		{name: "base_url", domain: "servicenowservices.com", baseURL: "https://itsm.example.com/", want: "https://itsm.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadConfig("test/servicenow_test.yml")
+			config.ServiceNow.Domain = tt.domain
+			config.ServiceNow.BaseURL = tt.baseURL
+
+			client, err := loadSnClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := client.(*ServiceNowClient).baseURL; got != tt.want {
+				t.Errorf("Unexpected baseURL: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSnClient_PasswordFile(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	defer loadConfig("test/servicenow_test.yml")
+	config.ServiceNow.Password = ""
+	config.ServiceNow.PasswordFile = "test/password"
+
+	client, err := loadSnClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snClient := client.(*ServiceNowClient)
+	if want := basicAuthHeader("prometheus_integration", "file_password"); snClient.authHeader != want {
+		t.Errorf("Unexpected authHeader: got %v, want %v", snClient.authHeader, want)
+	}
+	if snClient.passwordFile != "test/password" {
+		t.Errorf("Unexpected passwordFile: got %v", snClient.passwordFile)
+	}
+
+	config.ServiceNow.PasswordFile = "test/missing_password"
+	if _, err := loadSnClient(); err == nil {
+		t.Errorf("Expected an error with a missing password file, got none")
+	}
+}
+
+func TestLoadSnClient_Transport(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.ServiceNow.MaxIdleConns = 50
+	config.ServiceNow.MaxIdleConnsPerHost = 20
+	config.ServiceNow.IdleConnTimeout = time.Minute
+
+	client, err := loadSnClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := client.(*ServiceNowClient).client.Transport.(*http.Transport)
+	if transport.MaxIdleConns != 50 {
+		t.Errorf("Wrong MaxIdleConns: got %v, want %v", transport.MaxIdleConns, 50)
+	}
+	if transport.MaxIdleConnsPerHost != 20 {
+		t.Errorf("Wrong MaxIdleConnsPerHost: got %v, want %v", transport.MaxIdleConnsPerHost, 20)
+	}
+	if transport.IdleConnTimeout != time.Minute {
+		t.Errorf("Wrong IdleConnTimeout: got %v, want %v", transport.IdleConnTimeout, time.Minute)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"result":[]}`))
+	}))
+
+	loadConfig("test/servicenow_test.yml")
+	snClient, err := NewServiceNowClient("instance", "user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snClient.baseURL = ts.URL
+	serviceNow = snClient
+
+	checkHealth()
+	if got := testutil.ToFloat64(serviceNowUp); got != 1 {
+		t.Errorf("Wrong servicenow_up: got %v, want %v", got, 1)
+	}
+
+	ts.Close()
+	checkHealth()
+	if got := testutil.ToFloat64(serviceNowUp); got != 0 {
+		t.Errorf("Wrong servicenow_up: got %v, want %v", got, 0)
+	}
+}
+
+func TestServiceNowUp_NotRegisteredByDefault(t *testing.T) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "servicenow_up" {
+			t.Errorf("servicenow_up should only be exported when health_check_interval is set")
+		}
+	}
+}
+
+func TestLoadSnClient_ClientCertificate(t *testing.T) {
+	clientCert, err := ioutil.ReadFile("test/client.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientCert)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"result":[]}`))
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+
+	loadConfig("test/servicenow_test.yml")
+	config.ServiceNow.BaseURL = ts.URL
+	defer loadConfig("test/servicenow_test.yml")
+
+	check := func() error {
+		client, err := loadSnClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport := client.(*ServiceNowClient).client.Transport.(*http.Transport)
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+		transport.TLSClientConfig.RootCAs.AddCert(ts.Certificate())
+		return client.CheckHealth()
+	}
+
+	if err := check(); err == nil {
+		t.Errorf("Expected a handshake error without client certificate, got none")
+	}
+
+	config.ServiceNow.ClientCertFile = "test/client.crt"
+	config.ServiceNow.ClientKeyFile = "test/client.key"
+	if err := check(); err != nil {
+		t.Errorf("Unexpected error with client certificate: %v", err)
+	}
+
+	config.ServiceNow.ClientKeyFile = "test/client.crt"
+	if _, err := loadSnClient(); err == nil {
+		t.Errorf("Expected an error loading an invalid client key, got none")
+	}
+
+	config.ServiceNow.ClientKeyFile = ""
+	if err := config.validate(); err == nil || !strings.Contains(err.Error(), "client_cert_file and client_key_file must be both set") {
+		t.Errorf("Unexpected validation error: %v", err)
+	}
+}
+
+func TestLoadSnClient_DisableHTTP2(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+
+	client, err := loadSnClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport := client.(*ServiceNowClient).client.Transport.(*http.Transport); transport.TLSNextProto != nil {
+		t.Errorf("HTTP/2 should be negotiated by default: got TLSNextProto %v", transport.TLSNextProto)
+	}
+
+	config.ServiceNow.DisableHTTP2 = true
+	defer func() { config.ServiceNow.DisableHTTP2 = false }()
+	client, err = loadSnClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport := client.(*ServiceNowClient).client.Transport.(*http.Transport); transport.TLSNextProto == nil || len(transport.TLSNextProto) != 0 {
+		t.Errorf("HTTP/2 should be disabled: got TLSNextProto %v", transport.TLSNextProto)
+	}
+}
+
 func TestWebhookHandler_Firing_DoNotExists_OK(t *testing.T) {
-	loadConfig("config/servicenow_example.yml")
+	loadConfig("test/servicenow_test.yml")
 	incidentUpdateFields = map[string]bool{}
 	snClientMock := new(MockedSnClient)
 	serviceNow = snClientMock
@@ -75,14 +338,14 @@ func TestWebhookHandler_Firing_DoNotExists_OK(t *testing.T) {
 		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusOK)
 	}
 
-	want := `{"Status":200,"Message":"Success"}`
+	want := `{"status":200,"message":"Success"}`
 	if rr.Body.String() != want {
 		t.Errorf("Unexpected body: got %v, want %v", rr.Body.String(), want)
 	}
 }
 
 func TestWebhookHandler_Firing_Exists_Create_OK(t *testing.T) {
-	loadConfig("config/servicenow_example.yml")
+	loadConfig("test/servicenow_test.yml")
 	snClientMock := new(MockedSnClient)
 	serviceNow = snClientMock
 	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{Incident{"state": "6", "number": "INC42", "sys_id": "42"}}, nil)
@@ -109,14 +372,14 @@ func TestWebhookHandler_Firing_Exists_Create_OK(t *testing.T) {
 		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusOK)
 	}
 
-	want := `{"Status":200,"Message":"Success"}`
+	want := `{"status":200,"message":"Success"}`
 	if rr.Body.String() != want {
 		t.Errorf("Unexpected body: got %v, want %v", rr.Body.String(), want)
 	}
 }
 
 func TestWebhookHandler_Firing_Exists_Update_OK(t *testing.T) {
-	loadConfig("config/servicenow_example.yml")
+	loadConfig("test/servicenow_test.yml")
 	incidentUpdateFields = map[string]bool{
 		"comments": true,
 	}
@@ -151,14 +414,14 @@ func TestWebhookHandler_Firing_Exists_Update_OK(t *testing.T) {
 		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusOK)
 	}
 
-	want := `{"Status":200,"Message":"Success"}`
+	want := `{"status":200,"message":"Success"}`
 	if rr.Body.String() != want {
 		t.Errorf("Unexpected body: got %v, want %v", rr.Body.String(), want)
 	}
 }
 
 func TestWebhookHandler_Resolved_DoNotExists_OK(t *testing.T) {
-	loadConfig("config/servicenow_example.yml")
+	loadConfig("test/servicenow_test.yml")
 	snClientMock := new(MockedSnClient)
 	serviceNow = snClientMock
 	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
@@ -185,14 +448,14 @@ func TestWebhookHandler_Resolved_DoNotExists_OK(t *testing.T) {
 		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusOK)
 	}
 
-	want := `{"Status":200,"Message":"Success"}`
+	want := `{"status":200,"message":"Success"}`
 	if rr.Body.String() != want {
 		t.Errorf("Unexpected body: got %v, want %v", rr.Body.String(), want)
 	}
 }
 
 func TestWebhookHandler_Resolved_Exists_OK(t *testing.T) {
-	loadConfig("config/servicenow_example.yml")
+	loadConfig("test/servicenow_test.yml")
 	snClientMock := new(MockedSnClient)
 	serviceNow = snClientMock
 	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{Incident{"state": "7", "number": "INC42", "sys_id": "42"}}, nil)
@@ -219,150 +482,3002 @@ func TestWebhookHandler_Resolved_Exists_OK(t *testing.T) {
 		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusOK)
 	}
 
-	want := `{"Status":200,"Message":"Success"}`
+	want := `{"status":200,"message":"Success"}`
 	if rr.Body.String() != want {
 		t.Errorf("Unexpected body: got %v, want %v", rr.Body.String(), want)
 	}
 }
 
-func TestWebhookHandler_BadRequest(t *testing.T) {
-	loadConfig("config/servicenow_example.yml")
-
-	// Create a request to pass to the handler
-	req := httptest.NewRequest("GET", "/webhook", nil)
-
-	// Create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(webhook)
-
-	// Test the handler with the request and record the result
-	handler.ServeHTTP(rr, req)
+func TestOnAlertGroup_ResolveAllMatches(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.ResolveAllMatches = true
+	defer func() { config.Workflow.ResolveAllMatches = false }()
 
-	if status := rr.Code; status != http.StatusBadRequest {
-		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusBadRequest)
+	data := template.Data{
+		Status:      "resolved",
+		GroupLabels: template.KV{"alertname": "resolve_all"},
 	}
 
-	want := `{"Status":400,"Message":"EOF"}`
-	if rr.Body.String() != want {
-		t.Errorf("Unexpected body: got %v, want %v", rr.Body.String(), want)
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{
+		Incident{"state": "1", "number": "INC41", "sys_id": "41"},
+		Incident{"state": "2", "number": "INC42", "sys_id": "42"},
+	}, nil)
+	snClientMock.On("UpdateIncident", mock.Anything, "41").Return(Incident{}, errors.New("Update failed"))
+	snClientMock.On("UpdateIncident", mock.Anything, "42").Return(Incident{}, nil)
+
+	if err := onAlertGroup(data); err == nil {
+		t.Errorf("Expected an error, got none")
 	}
+	snClientMock.AssertCalled(t, "UpdateIncident", mock.Anything, "41")
+	snClientMock.AssertCalled(t, "UpdateIncident", mock.Anything, "42")
 }
 
-func TestWebhookHandler_InternalServerError(t *testing.T) {
-	loadConfig("config/servicenow_example.yml")
-	snClientMock := new(MockedSnClient)
-	serviceNow = snClientMock
-	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
-	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{}, errors.New("Error"))
+func TestOnAlertGroup_CloseOnFullResolve(t *testing.T) {
+	tests := []struct {
+		name      string
+		alerts    template.Alerts
+		wantClose bool
+	}{
+		{
+			name:      "all resolved",
+			alerts:    template.Alerts{{Status: "resolved"}, {Status: "resolved"}},
+			wantClose: true,
+		},
+		{
+			name:      "lingering firing alert",
+			alerts:    template.Alerts{{Status: "resolved"}, {Status: "firing"}},
+			wantClose: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadConfig("test/servicenow_test.yml")
+			config.Workflow.CloseOnFullResolve = true
+			config.Workflow.CloseFields = map[string]string{"state": "6", "close_notes": "{{ len .Alerts }} alert(s) resolved"}
+			defer func() {
+				config.Workflow.CloseOnFullResolve = false
+				config.Workflow.CloseFields = nil
+			}()
+
+			data := template.Data{
+				Status:      "resolved",
+				GroupLabels: template.KV{"alertname": "close_on_full_resolve"},
+				Alerts:      tt.alerts,
+			}
 
-	// Load a simple example of a body coming from AlertManager
-	data, err := ioutil.ReadFile("test/alertmanager_firing.json")
-	if err != nil {
-		t.Fatal(err)
+			snClientMock := mockServiceNow(Incident{"state": "2", "number": "INC42", "sys_id": "42"})
+
+			if err := onAlertGroup(data); err != nil {
+				t.Fatal(err)
+			}
+
+			update := snClientMock.incidentsOf("UpdateIncident")[0]
+			if _, closed := update["state"]; closed != tt.wantClose {
+				t.Errorf("Unexpected incident closure: got %v, want %v (update: %v)", closed, tt.wantClose, update)
+			}
+			if tt.wantClose && update["close_notes"] != "2 alert(s) resolved" {
+				t.Errorf("Unexpected close_notes: got %v", update["close_notes"])
+			}
+		})
 	}
+}
 
-	// Create a request to pass to the handler
-	req := httptest.NewRequest("GET", "/webhook", bytes.NewReader(data))
+func TestOnAlertGroup_CancelLabel(t *testing.T) {
+	tests := []struct {
+		name      string
+		labels    template.KV
+		wantState string
+		wantCode  string
+	}{
+		{name: "close", labels: template.KV{"alertname": "cancel_label"}, wantState: "6", wantCode: "Solved (Permanently)"},
+		{name: "cancel", labels: template.KV{"alertname": "cancel_label", "false_positive": "true"}, wantState: "8", wantCode: "Closed/Resolved by Caller"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadConfig("test/servicenow_test.yml")
+			config.Workflow.CloseOnFullResolve = true
+			config.Workflow.CloseFields = map[string]string{"state": "6", "close_code": "Solved (Permanently)"}
+			config.Workflow.CancelLabel = "false_positive"
+			config.Workflow.CancelFields = map[string]string{"state": "8", "close_code": "Closed/Resolved by Caller"}
+			defer loadConfig("test/servicenow_test.yml")
+
+			data := template.Data{
+				Status:       "resolved",
+				GroupLabels:  template.KV{"alertname": "cancel_label"},
+				CommonLabels: tt.labels,
+				Alerts:       template.Alerts{{Status: "resolved"}},
+			}
 
-	// Create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(webhook)
+			snClientMock := mockServiceNow(Incident{"state": "2", "number": "INC42", "sys_id": "42"})
 
-	// Test the handler with the request and record the result
-	handler.ServeHTTP(rr, req)
+			if err := onAlertGroup(data); err != nil {
+				t.Fatal(err)
+			}
 
-	if status := rr.Code; status != http.StatusInternalServerError {
-		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusInternalServerError)
+			update := snClientMock.incidentsOf("UpdateIncident")[0]
+			if update["state"] != tt.wantState || update["close_code"] != tt.wantCode {
+				t.Errorf("Unexpected state and close_code: got %v and %v, want %v and %v", update["state"], update["close_code"], tt.wantState, tt.wantCode)
+			}
+			if update["closed_by"] != "prometheus_integration" {
+				t.Errorf("Unexpected closed_by: got %v", update["closed_by"])
+			}
+		})
 	}
 
-	// Check the response body
-	want := `{"Status":500,"Message":"Error"}`
-	if rr.Body.String() != want {
-		t.Errorf("Unexpected body: got %v, want %v", rr.Body.String(), want)
+	// The cancel label would be ignored without close_on_full_resolve
+	config.Workflow.CancelLabel = "false_positive"
+	config.Workflow.CancelFields = map[string]string{"state": "8"}
+	defer loadConfig("test/servicenow_test.yml")
+	if err := config.validate(); err == nil || !strings.Contains(err.Error(), "cancel_label requires close_on_full_resolve") {
+		t.Errorf("Expected a cancel_label validation error, got %v", err)
 	}
 }
 
-func TestApplyTemplate_emptyText(t *testing.T) {
-	data := template.Data{}
-	text := ""
-	got, err := applyTemplate("name", text, data)
-	if err != nil {
-		t.Fatal(err)
+func TestOnAlertGroup_ResolveDeduped(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.CloseOnFullResolve = true
+	config.Workflow.CloseFields = map[string]string{"state": "6"}
+	// Resolved incidents stay updatable, as with a no_update_states list without the resolved state
+	noUpdateStates = map[string]bool{}
+	defer loadConfig("test/servicenow_test.yml")
+
+	data := template.Data{
+		Status:      "resolved",
+		GroupLabels: template.KV{"alertname": "resolve_deduped"},
+		Alerts:      template.Alerts{{Status: "resolved"}},
 	}
-	want := ""
-	if got != want {
-		t.Errorf("Unexpected result: got %v, want %v", got, want)
+	before := testutil.ToFloat64(webhookResolveDeduped)
+
+	for _, state := range []string{"2", "6"} {
+		snClientMock := new(MockedSnClient)
+		serviceNow = snClientMock
+		snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{{"state": state, "number": "INC42", "sys_id": "42"}}, nil)
+		snClientMock.On("UpdateIncident", mock.Anything, "42").Return(Incident{"state": "6"}, nil)
+
+		if err := onAlertGroup(data); err != nil {
+			t.Fatal(err)
+		}
+		wantUpdates := 1
+		if state == "6" {
+			wantUpdates = 0
+		}
+		snClientMock.AssertNumberOfCalls(t, "UpdateIncident", wantUpdates)
+	}
+	if got := testutil.ToFloat64(webhookResolveDeduped) - before; got != 1 {
+		t.Errorf("Unexpected webhook_resolve_deduped_total increase: got %v, want 1", got)
 	}
 }
 
-func TestApplyTemplate_OK(t *testing.T) {
+func TestOnAlertGroup_Reopen(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.CloseFields = map[string]string{"state": "6"}
+	config.Workflow.ReopenState = "2"
+	config.Workflow.ReopenComment = "Reopened: {{ .CommonLabels.alertname }} re-fired"
+	// Resolved incidents stay updatable, as with a no_update_states list without the resolved state
+	noUpdateStates = map[string]bool{}
+	defer loadConfig("test/servicenow_test.yml")
+
 	data := template.Data{
-		Status: "firing",
-		CommonAnnotations: map[string]string{
-			"error": "my error",
-		},
+		Status:       "firing",
+		GroupLabels:  template.KV{"alertname": "reopen"},
+		CommonLabels: template.KV{"alertname": "reopen"},
 	}
-	text := "Status is {{.Status}} and error is {{.CommonAnnotations.error}}"
-	got, err := applyTemplate("name", text, data)
-	if err != nil {
-		t.Fatal(err)
+
+	tests := []struct {
+		state       string
+		wantReopen  bool
+		wantComment string
+	}{
+		{state: "6", wantReopen: true, wantComment: "Reopened: reopen re-fired"},
+		{state: "2", wantReopen: false},
 	}
-	want := "Status is firing and error is my error"
-	if string(got) != want {
-		t.Errorf("Unexpected result: got %v, want %v", got, want)
+	for _, tt := range tests {
+		snClientMock := mockServiceNow(Incident{"state": tt.state, "number": "INC42", "sys_id": "42"})
+
+		if err := onAlertGroup(data); err != nil {
+			t.Fatal(err)
+		}
+
+		update := snClientMock.incidentsOf("UpdateIncident")[0]
+		if _, reopened := update["state"]; reopened != tt.wantReopen {
+			t.Errorf("Unexpected reopen of incident in state %s: got %v, want %v (update: %v)", tt.state, reopened, tt.wantReopen, update)
+		}
+		if tt.wantReopen && (update["state"] != "2" || update["comments"] != tt.wantComment) {
+			t.Errorf("Unexpected reopen state and comment: got %v and %v, want 2 and %v", update["state"], update["comments"], tt.wantComment)
+		}
 	}
 }
 
-func TestApplyIncidentTemplate_Range(t *testing.T) {
+func TestOnAlertGroup_ResolveComment(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.ResolveComment = "All {{ len .ResolvedAlerts }} alert(s) resolved"
+	config.Workflow.ResolveCommentField = "work_notes"
+	defer func() {
+		config.Workflow.ResolveComment = ""
+		config.Workflow.ResolveCommentField = ""
+	}()
+
 	data := template.Data{
-		CommonAnnotations: map[string]string{
-			"error":   "a",
-			"warning": "b",
-		},
+		Status:      "resolved",
+		GroupLabels: template.KV{"alertname": "resolve_comment"},
+		Alerts:      template.Alerts{{Status: "resolved"}, {Status: "resolved"}, {Status: "resolved"}},
 	}
-	incident := Incident{
-		"description": "{{ range $key, $val := .CommonAnnotations}}{{ $key }}:{{ $val }} {{end}}",
-	}
-	applyIncidentTemplate(incident, data)
 
-	got := incident["description"]
-	want := "error:a warning:b "
+	snClientMock := mockServiceNow(Incident{"state": "2", "number": "INC42", "sys_id": "42"})
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
 
-	if got != want {
-		t.Errorf("Unexpected result: got %v, want %v", got, want)
+	update := snClientMock.incidentsOf("UpdateIncident")[0]
+	if got, want := update["work_notes"], "All 3 alert(s) resolved"; got != want {
+		t.Errorf("Unexpected resolve comment: got %v, want %v", got, want)
+	}
+	if _, ok := update["comments"]; !ok {
+		t.Errorf("The generic update fields should still be sent: got %v", update)
 	}
 }
 
-func TestLoadConfigContent_Ok_Minimal(t *testing.T) {
-	configFile := `
-service_now:
- instance_name: "instance"
- user_name: "SA"
- password: "SA!" 
-workflow:
- incident_group_key_field: "u_other_reference_1"
-`
-	want := Config{
-		ServiceNow: ServiceNowConfig{
-			InstanceName: "instance",
-			UserName:     "SA",
-			Password:     "SA!",
-		},
-		Workflow: WorkflowConfig{
-			IncidentGroupKeyField: "u_other_reference_1",
-		},
-		DefaultIncident: nil,
+func TestCloseFields_Closer(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.CloseFields = map[string]string{"state": "6"}
+	defer func() { config.Workflow.CloseFields = nil }()
+
+	fields := closeFields(template.Data{})
+	if fields["resolved_by"] != "prometheus_integration" || fields["closed_by"] != "prometheus_integration" {
+		t.Errorf("Unexpected closer fields: got %v", fields)
 	}
-	got, err := loadConfigContent([]byte(configFile))
-	if err != nil {
-		t.Errorf("Error on loading config content %v", err)
+
+	config.Workflow.CloseFields["closed_by"] = "{{ .CommonLabels.owner }}"
+	config.Workflow.CloseFields["resolved_by"] = ""
+	fields = closeFields(template.Data{CommonLabels: template.KV{"owner": "noc"}})
+	if fields["closed_by"] != "noc" {
+		t.Errorf("Unexpected closed_by: got %v, want %v", fields["closed_by"], "noc")
 	}
-	if !reflect.DeepEqual(got, want) {
-		t.Errorf("Error in getting config Got:%v, Expected config:%v", got, want)
+	if fields["resolved_by"] != "prometheus_integration" {
+		t.Errorf("Unexpected resolved_by: got %v, want %v", fields["resolved_by"], "prometheus_integration")
+	}
+
+	config.ServiceNow.UserName = ""
+	fields = closeFields(template.Data{CommonLabels: template.KV{"owner": "noc"}})
+	if _, ok := fields["resolved_by"]; ok {
+		t.Errorf("Unexpected resolved_by without any known user: got %v", fields["resolved_by"])
+	}
+	if err := config.validate(); err == nil || !strings.Contains(err.Error(), "close_fields with a state requires resolved_by and closed_by") {
+		t.Errorf("Expected a close_fields validation error, got %v", err)
 	}
 }
 
-func TestLoadConfigContent_Ok_Standard(t *testing.T) {
+func TestOnAlertGroup_DedupTTL(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.DedupTTL = time.Minute
+	defer func() { config.Workflow.DedupTTL = 0 }()
+	current := time.Unix(600, 0)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	data := template.Data{
+		Status:      "firing",
+		GroupLabels: template.KV{"alertname": "dedup_ttl"},
+		Alerts:      template.Alerts{{Status: "firing", Labels: template.KV{"instance": "server01"}}},
+	}
+
+	snClientMock := mockServiceNow(Incident{"state": "1", "number": "INC42", "sys_id": "42"})
+
+	before := testutil.ToFloat64(webhookDeduped)
+	for i := 0; i < 2; i++ {
+		if err := onAlertGroup(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 1)
+	if got := testutil.ToFloat64(webhookDeduped) - before; got != 1 {
+		t.Errorf("Unexpected webhook_deduped_total increase: got %v, want 1", got)
+	}
+
+	data.Alerts = append(data.Alerts, template.Alert{Status: "firing", Labels: template.KV{"instance": "server02"}})
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 2)
+
+	current = current.Add(2 * time.Minute)
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 3)
+}
+
+func TestOnAlertGroup_EmptyResultRetries(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.DedupTTL = time.Minute
+	config.Workflow.EmptyResultRetries = 2
+	config.Workflow.EmptyResultRetryDelay = time.Millisecond
+	defer loadConfig("test/servicenow_test.yml")
+	dedupCache = map[string]dedupEntry{}
+
+	data := template.Data{
+		Status:      "firing",
+		GroupLabels: template.KV{"alertname": "empty_result_retries"},
+		Alerts:      template.Alerts{{Status: "firing", Labels: template.KV{"instance": "server01"}}},
+	}
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	// The incident created on the first notification is only returned by the second search of the next notification
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil).Twice()
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{{"state": "1", "number": "INC42", "sys_id": "42"}}, nil)
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{"number": "INC42", "sys_id": "42"}, nil)
+	snClientMock.On("UpdateIncident", mock.Anything, "42").Return(Incident{}, nil)
+
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNumberOfCalls(t, "GetIncidents", 1)
+
+	data.Alerts = append(data.Alerts, template.Alert{Status: "firing", Labels: template.KV{"instance": "server02"}})
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNumberOfCalls(t, "GetIncidents", 3)
+	snClientMock.AssertNumberOfCalls(t, "CreateIncident", 1)
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 1)
+}
+
+func TestOnAlertGroup_StartupDedupWindow(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.StartupDedupWindow = 10 * time.Minute
+	config.Workflow.EmptyResultRetryDelay = time.Millisecond
+	defer loadConfig("test/servicenow_test.yml")
+	current := time.Unix(3600, 0)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+	start := startTime
+	startTime = current
+	defer func() { startTime = start }()
+
+	data := template.Data{
+		Status:      "firing",
+		GroupLabels: template.KV{"alertname": "startup_dedup_window"},
+		Alerts:      template.Alerts{{Status: "firing"}},
+	}
+
+	snClientMock := mockServiceNow()
+
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	var methods []string
+	for _, call := range snClientMock.Calls {
+		methods = append(methods, call.Method)
+	}
+	// The empty search is retried although the dedup cache expects no incident, as it is lost on restart
+	if want := []string{"GetIncidents", "GetIncidents", "CreateIncident"}; !reflect.DeepEqual(methods, want) {
+		t.Errorf("Unexpected calls within the startup window: got %v, want %v", methods, want)
+	}
+
+	current = current.Add(11 * time.Minute)
+	snClientMock.Calls = nil
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNumberOfCalls(t, "GetIncidents", 1)
+	snClientMock.AssertNumberOfCalls(t, "CreateIncident", 1)
+
+	// An incident only returned by the retried search, as created just before the restart, is updated
+	current = startTime
+	snClientMock = new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil).Once()
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{{"state": "2", "number": "INC42", "sys_id": "42"}}, nil)
+	snClientMock.On("UpdateIncident", mock.Anything, mock.Anything).Return(Incident{}, nil)
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertCalled(t, "UpdateIncident", mock.Anything, "42")
+	snClientMock.AssertNotCalled(t, "CreateIncident", mock.Anything)
+}
+
+func TestOnAlertGroup_StartupDedupWindow_GetError(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.StartupDedupWindow = 10 * time.Minute
+	config.Workflow.OnGetError = onGetErrorCreateAnyway
+	defer loadConfig("test/servicenow_test.yml")
+	start := startTime
+	startTime = time.Now()
+	defer func() { startTime = start }()
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, errors.New("ServiceNow is down"))
+
+	data := template.Data{Status: "firing", GroupLabels: template.KV{"alertname": "startup_dedup_window"}}
+	if err := onAlertGroup(data); err == nil {
+		t.Errorf("Expected an error, got none")
+	}
+	snClientMock.AssertNotCalled(t, "CreateIncident", mock.Anything)
+}
+
+func TestOnAlertGroup_CallerFromLabel(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.CallerFromLabel = "owner"
+	defer func() { config.Workflow.CallerFromLabel = "" }()
+	callerCache = map[string]callerEntry{}
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{"number": "INC42", "sys_id": "42"}, nil)
+	snClientMock.On("GetUserSysID", "jdoe").Return("user_42", nil)
+	snClientMock.On("GetUserSysID", "nobody").Return("", nil)
+
+	tests := []struct {
+		owner string
+		want  string
+	}{
+		{owner: "jdoe", want: "user_42"},
+		{owner: "jdoe", want: "user_42"},
+		{owner: "nobody", want: "prometheus_integration"},
+		{owner: "", want: "prometheus_integration"},
+	}
+	for _, tt := range tests {
+		data := template.Data{
+			Status:       "firing",
+			GroupLabels:  template.KV{"alertname": "caller_from_label"},
+			CommonLabels: template.KV{"owner": tt.owner},
+		}
+		if err := onAlertGroup(data); err != nil {
+			t.Fatal(err)
+		}
+		created := snClientMock.incidentsOf("CreateIncident")
+		incident := created[len(created)-1]
+		if got := incident["caller_id"]; got != tt.want {
+			t.Errorf("Unexpected caller_id for owner %q: got %v, want %v", tt.owner, got, tt.want)
+		}
+	}
+	// Each known and unknown user is looked up once, then cached
+	snClientMock.AssertNumberOfCalls(t, "GetUserSysID", 2)
+
+	// Unknown users are looked up again once expired, unlike known ones
+	defer func() { now = time.Now }()
+	later := time.Now().Add(unknownCallerTTL)
+	now = func() time.Time { return later }
+	resolveCaller("jdoe")
+	resolveCaller("nobody")
+	snClientMock.AssertNumberOfCalls(t, "GetUserSysID", 3)
+	if _, ok := callerCache["nobody"]; !ok {
+		t.Errorf("Expected the unknown user to be cached again")
+	}
+}
+
+func TestOnAlertGroup_Audit(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	var buf bytes.Buffer
+	auditWriter = &buf
+	defer func() { auditWriter = nil }()
+	now = func() time.Time { return time.Unix(600, 0) }
+	defer func() { now = time.Now }()
+
+	mockServiceNow()
+
+	data := template.Data{Status: "firing", GroupLabels: template.KV{"alertname": "audit"}}
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+
+	var record AuditRecord
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Unexpected audit line %q: %v", buf.String(), err)
+	}
+	want := AuditRecord{
+		Time:           time.Unix(600, 0).UTC(),
+		Action:         "create",
+		GroupKey:       getGroupKey(data),
+		IncidentNumber: "INC42",
+		SysID:          "42",
+		Actor:          "prometheus_integration",
+	}
+	if !reflect.DeepEqual(record, want) {
+		t.Errorf("Unexpected audit record: got %+v, want %+v", record, want)
+	}
+	if !strings.HasSuffix(buf.String(), "}\n") || strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("Audit record should be a single JSON line: %q", buf.String())
+	}
+}
+
+func TestAudit_WriteError(t *testing.T) {
+	auditWriter = errorWriter{}
+	defer func() { auditWriter = nil }()
+
+	before := testutil.ToFloat64(auditErrors)
+	audit("update", "group_key", Incident{"number": "INC42"}, "prometheus_integration", nil)
+	if got := testutil.ToFloat64(auditErrors) - before; got != 1 {
+		t.Errorf("Unexpected webhook_audit_errors_total increase: got %v, want 1", got)
+	}
+}
+
+type errorWriter struct{}
+
+func (errorWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestOnAlertGroup_ConflictRetry(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil).Once()
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident(nil), errConflict).Once()
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{{"state": "1", "number": "INC42", "sys_id": "42"}}, nil).Once()
+	snClientMock.On("UpdateIncident", mock.Anything, "42").Return(Incident{}, nil).Once()
+
+	data := template.Data{Status: "firing", GroupLabels: template.KV{"alertname": "conflict"}}
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertExpectations(t)
+	snClientMock.AssertNumberOfCalls(t, "CreateIncident", 1)
+}
+
+func TestOnAlertGroup_TableBySeverity(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.TableBySeverity = map[string]string{"warning": "u_alert_log"}
+	defer func() { config.Workflow.TableBySeverity = nil }()
+
+	firing := template.Data{
+		Status:       "firing",
+		GroupLabels:  template.KV{"alertname": "table_by_severity"},
+		CommonLabels: template.KV{"severity": "warning"},
+	}
+	resolved := template.Data{Status: "resolved", GroupLabels: firing.GroupLabels, CommonLabels: firing.CommonLabels}
+
+	// The incident is created, found again, updated and resolved in the table of its severity
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidentsInTable", mock.Anything, "u_alert_log").Return([]Incident{}, nil).Once()
+	snClientMock.On("GetIncidentsInTable", mock.Anything, "u_alert_log").Return([]Incident{{"state": "1", "number": "ALG42", "sys_id": "42"}}, nil)
+	snClientMock.On("CreateIncidentInTable", mock.Anything, "u_alert_log").Return(Incident{"number": "ALG42", "sys_id": "42"}, nil)
+	snClientMock.On("UpdateIncidentInTable", mock.Anything, "42", "u_alert_log").Return(Incident{}, nil)
+	for _, data := range []template.Data{firing, firing, resolved} {
+		if err := onAlertGroup(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snClientMock.AssertNumberOfCalls(t, "CreateIncidentInTable", 1)
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncidentInTable", 2)
+	for _, method := range []string{"GetIncidents", "CreateIncident", "UpdateIncident"} {
+		snClientMock.AssertNumberOfCalls(t, method, 0)
+	}
+
+	// Other severities use the incident table
+	snClientMock = new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{"number": "INC42", "sys_id": "42"}, nil)
+	firing.CommonLabels = template.KV{"severity": "critical"}
+	if err := onAlertGroup(firing); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNumberOfCalls(t, "CreateIncident", 1)
+}
+
+func TestOnAlertGroup_MinUpdateInterval(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.MinUpdateInterval = 5 * time.Minute
+	defer func() { config.Workflow.MinUpdateInterval = 0 }()
+	current := time.Unix(3600, 0)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	snClientMock := mockServiceNow(Incident{"state": "1", "number": "INC42", "sys_id": "42"})
+
+	firing := template.Data{Status: "firing", GroupLabels: template.KV{"alertname": "min_update_interval"}}
+	before := testutil.ToFloat64(webhookUpdateThrottled)
+	for i := 0; i < 2; i++ {
+		if err := onAlertGroup(firing); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 1)
+	if got := testutil.ToFloat64(webhookUpdateThrottled) - before; got != 1 {
+		t.Errorf("Unexpected webhook_update_throttled_total increase: got %v, want 1", got)
+	}
+
+	current = current.Add(5 * time.Minute)
+	if err := onAlertGroup(firing); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 2)
+
+	resolved := template.Data{Status: "resolved", GroupLabels: firing.GroupLabels}
+	if err := onAlertGroup(resolved); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 3)
+}
+
+func TestOnAlertGroup_WebhookVersionField(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.WebhookVersionField = "u_webhook_version"
+	defer loadConfig("test/servicenow_test.yml")
+	defaultVersion := version.Version
+	version.Version = "1.2.3"
+	defer func() { version.Version = defaultVersion }()
+
+	data := template.Data{Status: "firing", GroupLabels: template.KV{"alertname": "webhook_version_field"}}
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil).Once()
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{{"state": "1", "number": "INC42", "sys_id": "42"}}, nil)
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{}, nil)
+	snClientMock.On("UpdateIncident", mock.Anything, "42").Return(Incident{}, nil)
+
+	for i := 0; i < 2; i++ {
+		if err := onAlertGroup(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if created := snClientMock.incidentsOf("CreateIncident")[0]; created["u_webhook_version"] != "1.2.3" {
+		t.Errorf("Unexpected webhook version on create: got %v, want %v", created["u_webhook_version"], "1.2.3")
+	}
+	if updated := snClientMock.incidentsOf("UpdateIncident")[0]; updated["u_webhook_version"] != nil {
+		t.Errorf("Webhook version should not be updated by default: got %v", updated["u_webhook_version"])
+	}
+}
+
+func TestOnAlertGroup_CoalesceWindow(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.DefaultIncident["comments"] = "{{ len .Alerts }} alert(s)"
+	config.Workflow.CoalesceWindow = time.Hour
+	defer loadConfig("test/servicenow_test.yml")
+
+	snClientMock := mockServiceNow(Incident{"state": "1", "number": "INC42", "sys_id": "42"})
+
+	firing := template.Data{Status: "firing", GroupLabels: template.KV{"alertname": "coalesce_window"}}
+	before := testutil.ToFloat64(webhookUpdatesCoalesced)
+	for i := 0; i < 2; i++ {
+		firing.Alerts = append(firing.Alerts, template.Alert{Status: "firing"})
+		if err := onAlertGroup(firing); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snClientMock.AssertNotCalled(t, "UpdateIncident", mock.Anything, "42")
+	if got := testutil.ToFloat64(webhookUpdatesCoalesced) - before; got != 1 {
+		t.Errorf("Unexpected webhook_updates_coalesced_total increase: got %v, want 1", got)
+	}
+
+	// End of the coalesce window
+	flushUpdate(getGroupKey(firing))
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 1)
+	if update := snClientMock.incidentsOf("UpdateIncident")[0]; update["comments"] != "2 alert(s)" {
+		t.Errorf("Unexpected coalesced update: got %v, want the latest comments", update)
+	}
+
+	// A resolve sends the pending update immediately, before the resolve update
+	if err := onAlertGroup(firing); err != nil {
+		t.Fatal(err)
+	}
+	resolved := template.Data{Status: "resolved", GroupLabels: firing.GroupLabels, Alerts: template.Alerts{{Status: "resolved"}}}
+	if err := onAlertGroup(resolved); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 3)
+	if update := snClientMock.incidentsOf("UpdateIncident")[1]; update["comments"] != "2 alert(s)" {
+		t.Errorf("Unexpected flushed update: got %v", update)
+	}
+	if update := snClientMock.incidentsOf("UpdateIncident")[2]; update["comments"] != "1 alert(s)" {
+		t.Errorf("Unexpected resolve update: got %v", update)
+	}
+}
+
+func TestOnAlertGroup_CoalesceWindow_FlushError(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.DefaultIncident["comments"] = "{{ len .Alerts }} alert(s)"
+	config.Workflow.CoalesceWindow = time.Hour
+	defer loadConfig("test/servicenow_test.yml")
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{{"state": "1", "number": "INC42", "sys_id": "42"}}, nil)
+	snClientMock.On("UpdateIncident", mock.Anything, "42").Return(Incident{}, unavailableError{errors.New("ServiceNow returned the HTTP error code: 503")}).Once()
+	snClientMock.On("UpdateIncident", mock.Anything, "42").Return(Incident{}, nil)
+
+	firing := template.Data{Status: "firing", GroupLabels: template.KV{"alertname": "coalesce_window_flush_error"}, Alerts: template.Alerts{{Status: "firing"}}}
+	if err := onAlertGroup(firing); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed update is counted and kept pending for the next flush
+	before := testutil.ToFloat64(serviceNowError)
+	flushUpdate(getGroupKey(firing))
+	if got := testutil.ToFloat64(serviceNowError) - before; got != 1 {
+		t.Errorf("Unexpected servicenow_errors_total increase: got %v, want 1", got)
+	}
+	flushUpdate(getGroupKey(firing))
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 2)
+	if update := snClientMock.incidentsOf("UpdateIncident")[1]; update["comments"] != "1 alert(s)" {
+		t.Errorf("Unexpected update sent on the next flush: got %v", update)
+	}
+
+	flushUpdate(getGroupKey(firing))
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 2)
+}
+
+func TestOnAlertGroup_MinFiringDuration(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.MinFiringDuration = 5 * time.Minute
+	defer func() { config.Workflow.MinFiringDuration = 0 }()
+	current := time.Unix(3600, 0)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	tests := []struct {
+		name      string
+		startsAt  time.Time
+		existing  []Incident
+		wantErr   error
+		wantCalls map[string]int
+	}{
+		{name: "fresh alert held", startsAt: current.Add(-time.Minute), wantErr: errIncidentHeld, wantCalls: map[string]int{"CreateIncident": 0}},
+		{name: "old alert created", startsAt: current.Add(-10 * time.Minute), wantCalls: map[string]int{"CreateIncident": 1}},
+		{name: "fresh alert updated", startsAt: current.Add(-time.Minute), existing: []Incident{{"state": "1", "number": "INC42", "sys_id": "42"}}, wantCalls: map[string]int{"UpdateIncident": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := template.Data{
+				Status:      "firing",
+				GroupLabels: template.KV{"alertname": "min_firing_duration"},
+				Alerts: template.Alerts{
+					{Status: "firing", StartsAt: current.Add(-30 * time.Second)},
+					{Status: "firing", StartsAt: tt.startsAt},
+				},
+			}
+
+			snClientMock := new(MockedSnClient)
+			serviceNow = snClientMock
+			snClientMock.On("GetIncidents", mock.Anything).Return(tt.existing, nil)
+			snClientMock.On("CreateIncident", mock.Anything).Return(Incident{"number": "INC42", "sys_id": "42"}, nil)
+			snClientMock.On("UpdateIncident", mock.Anything, "42").Return(Incident{}, nil)
+
+			if err := onAlertGroup(data); err != tt.wantErr {
+				t.Errorf("Unexpected error: got %v, want %v", err, tt.wantErr)
+			}
+			for method, calls := range tt.wantCalls {
+				snClientMock.AssertNumberOfCalls(t, method, calls)
+			}
+		})
+	}
+
+	body := `{"status": "firing", "groupLabels": {"alertname": "min_firing_duration"}, "alerts": [{"status": "firing", "startsAt": "` + current.Format(time.RFC3339) + `"}]}`
+	mockServiceNow()
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(webhook).ServeHTTP(rr, httptest.NewRequest("POST", "/webhook", strings.NewReader(body)))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Held") {
+		t.Errorf("Unexpected held response: got %v %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestOnAlertGroup_OnGetError(t *testing.T) {
+	data := template.Data{
+		Status:      "firing",
+		GroupLabels: template.KV{"alertname": "on_get_error"},
+	}
+
+	tests := []struct {
+		name        string
+		policy      string
+		wantErr     bool
+		wantCreates int
+	}{
+		{name: "default", policy: "", wantErr: true, wantCreates: 0},
+		{name: "fail", policy: "fail", wantErr: true, wantCreates: 0},
+		{name: "create_anyway", policy: "create_anyway", wantErr: false, wantCreates: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadConfig("test/servicenow_test.yml")
+			config.Workflow.OnGetError = tt.policy
+
+			snClientMock := new(MockedSnClient)
+			serviceNow = snClientMock
+			snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, errors.New("Get failed"))
+			snClientMock.On("CreateIncident", mock.Anything).Return(Incident{"number": "INC42", "sys_id": "42"}, nil)
+
+			if err := onAlertGroup(data); (err != nil) != tt.wantErr {
+				t.Errorf("onAlertGroup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			snClientMock.AssertNumberOfCalls(t, "CreateIncident", tt.wantCreates)
+		})
+	}
+}
+
+func TestWebhookHandler_Gzip(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{}, nil)
+
+	data, err := ioutil.ReadFile("test/alertmanager_firing.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Write(data)
+	gzipWriter.Close()
+
+	req := httptest.NewRequest("POST", "/webhook", &compressed)
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(webhook).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusOK)
+	}
+	snClientMock.AssertNumberOfCalls(t, "CreateIncident", 1)
+
+	// Malformed gzip body
+	req = httptest.NewRequest("POST", "/webhook", bytes.NewReader(data))
+	req.Header.Set("Content-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(webhook).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusBadRequest)
+	}
+
+	// Gzip bomb, small once compressed
+	compressed.Reset()
+	gzipWriter = gzip.NewWriter(&compressed)
+	gzipWriter.Write(bytes.Repeat([]byte(" "), maxDecompressedBodySize+1))
+	gzipWriter.Close()
+	req = httptest.NewRequest("POST", "/webhook", &compressed)
+	req.Header.Set("Content-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(webhook).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Wrong status code of a gzip bomb: got %v, want %v", status, http.StatusRequestEntityTooLarge)
+	}
+
+	// Body too large as sent
+	req = httptest.NewRequest("POST", "/webhook", bytes.NewReader(make([]byte, maxRequestBodySize+1)))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(webhook).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Wrong status code of a large body: got %v, want %v", status, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestNewServer_Timeouts(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Web.ReadTimeout = 5 * time.Second
+	config.Web.MaxHeaderBytes = 4096
+	defer func() { config.Web = WebConfig{} }()
+
+	server := newServer(":9877", http.NotFoundHandler())
+
+	if server.ReadTimeout != 5*time.Second {
+		t.Errorf("Unexpected ReadTimeout: got %v, want %v", server.ReadTimeout, 5*time.Second)
+	}
+	if server.ReadHeaderTimeout != defaultReadHeaderTimeout {
+		t.Errorf("Unexpected ReadHeaderTimeout: got %v, want %v", server.ReadHeaderTimeout, defaultReadHeaderTimeout)
+	}
+	if server.WriteTimeout != defaultWriteTimeout {
+		t.Errorf("Unexpected WriteTimeout: got %v, want %v", server.WriteTimeout, defaultWriteTimeout)
+	}
+	if server.IdleTimeout != defaultIdleTimeout {
+		t.Errorf("Unexpected IdleTimeout: got %v, want %v", server.IdleTimeout, defaultIdleTimeout)
+	}
+	if server.MaxHeaderBytes != 4096 {
+		t.Errorf("Unexpected MaxHeaderBytes: got %v, want %v", server.MaxHeaderBytes, 4096)
+	}
+}
+
+func TestDecodeRequestBody_PayloadJSONPath(t *testing.T) {
+	config.Web.PayloadJSONPath = "data"
+	defer func() { config.Web.PayloadJSONPath = "" }()
+
+	data, err := decodeRequestBody([]byte(`{"data": {"status": "firing", "receiver": "admins"}, "source": "transformer"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Status != "firing" || data.Receiver != "admins" {
+		t.Errorf("Unexpected data: got %v", data)
+	}
+
+	if _, err := decodeRequestBody([]byte(`{"status": "firing"}`)); err == nil {
+		t.Errorf("Expected an error, got none")
+	}
+}
+
+func TestWebhookHandler_BadRequest(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+
+	// Create a request to pass to the handler
+	req := httptest.NewRequest("GET", "/webhook", nil)
+
+	// Create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(webhook)
+
+	// Test the handler with the request and record the result
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusBadRequest)
+	}
+
+	want := `{"status":400,"message":"EOF"}`
+	if rr.Body.String() != want {
+		t.Errorf("Unexpected body: got %v, want %v", rr.Body.String(), want)
+	}
+}
+
+func TestWebhookHandler_InternalServerError(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{}, errors.New("Error"))
+
+	// Load a simple example of a body coming from AlertManager
+	data, err := ioutil.ReadFile("test/alertmanager_firing.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a request to pass to the handler
+	req := httptest.NewRequest("GET", "/webhook", bytes.NewReader(data))
+
+	// Create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(webhook)
+
+	// Test the handler with the request and record the result
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusInternalServerError)
+	}
+
+	// Check the response body
+	want := `{"status":500,"message":"Error"}`
+	if rr.Body.String() != want {
+		t.Errorf("Unexpected body: got %v, want %v", rr.Body.String(), want)
+	}
+}
+
+func TestOnAlertGroup_MinSeverity(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.MinSeverity = "warning"
+	defer func() { config.Workflow.MinSeverity = "" }()
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{}, nil)
+
+	info := template.Data{
+		Status:       "firing",
+		GroupLabels:  template.KV{"alertname": "info_alert"},
+		CommonLabels: template.KV{"alertname": "info_alert", "severity": "info"},
+	}
+	if err := onAlertGroup(info); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNotCalled(t, "GetIncidents", mock.Anything)
+	snClientMock.AssertNotCalled(t, "CreateIncident", mock.Anything)
+
+	critical := template.Data{
+		Status:       "firing",
+		GroupLabels:  template.KV{"alertname": "critical_alert"},
+		CommonLabels: template.KV{"alertname": "critical_alert", "severity": "critical"},
+	}
+	if err := onAlertGroup(critical); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNumberOfCalls(t, "CreateIncident", 1)
+}
+
+func TestOnAlertGroup_UpdateCount(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.UpdateCountField = "u_alert_update_count"
+	defer func() { config.Workflow.UpdateCountField = "" }()
+
+	data := template.Data{
+		Status:      "firing",
+		GroupLabels: template.KV{"alertname": "update_count"},
+	}
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil).Once()
+	snClientMock.On("CreateIncident", mock.Anything).Run(func(args mock.Arguments) {
+		incident := args.Get(0).(Incident)
+		if got := incident["u_alert_update_count"]; got != "1" {
+			t.Errorf("Wrong update count on create: got %v, want %v", got, "1")
+		}
+	}).Return(Incident{"state": "1", "number": "INC42", "sys_id": "42", "u_alert_update_count": "1"}, nil)
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{Incident{"state": "1", "number": "INC42", "sys_id": "42", "u_alert_update_count": "1"}}, nil).Once()
+	snClientMock.On("UpdateIncident", mock.Anything, "42").Run(func(args mock.Arguments) {
+		incident := args.Get(0).(Incident)
+		if got := incident["u_alert_update_count"]; got != "2" {
+			t.Errorf("Wrong update count on update: got %v, want %v", got, "2")
+		}
+	}).Return(Incident{}, nil)
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 1)
+}
+
+func TestOnAlertGroup_Escalation(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.UpdateCountField = "u_alert_update_count"
+	config.Workflow.Escalation = []EscalationRule{{UpdateCount: 3, AssignmentGroup: "Level 2"}, {UpdateCount: 10, AssignmentGroup: "Level 3"}}
+	defer func() {
+		config.Workflow.UpdateCountField = ""
+		config.Workflow.Escalation = nil
+	}()
+
+	data := template.Data{
+		Status:      "firing",
+		GroupLabels: template.KV{"alertname": "escalation"},
+	}
+
+	tests := []struct {
+		count string
+		want  interface{}
+	}{
+		{count: "1", want: nil},
+		{count: "2", want: "Level 2"},
+		{count: "3", want: nil},
+		{count: "9", want: "Level 3"},
+	}
+	for _, tt := range tests {
+		snClientMock := mockServiceNow(Incident{"state": "1", "number": "INC42", "sys_id": "42", "u_alert_update_count": tt.count})
+		if err := onAlertGroup(data); err != nil {
+			t.Fatal(err)
+		}
+
+		update := snClientMock.incidentsOf("UpdateIncident")[0]
+		if got := update["assignment_group"]; got != tt.want {
+			t.Errorf("Unexpected assignment_group with update count %s: got %v, want %v", tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestOnAlertGroup_MajorIncident(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.MajorIncident = MajorIncidentRule{MinAlerts: 3, Label: "severity", LabelValue: "critical", Field: "major_incident_state", Value: "proposed"}
+	defer func() { config.Workflow.MajorIncident = MajorIncidentRule{} }()
+
+	tests := []struct {
+		name     string
+		severity string
+		alerts   int
+		want     interface{}
+	}{
+		{name: "above threshold", severity: "critical", alerts: 3, want: "proposed"},
+		{name: "below threshold", severity: "critical", alerts: 2, want: nil},
+		{name: "other severity", severity: "warning", alerts: 5, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := template.Data{
+				Status:       "firing",
+				GroupLabels:  template.KV{"alertname": "major_incident"},
+				CommonLabels: template.KV{"severity": tt.severity},
+			}
+			for i := 0; i < tt.alerts; i++ {
+				data.Alerts = append(data.Alerts, template.Alert{Status: "firing"})
+			}
+
+			snClientMock := mockServiceNow()
+			if err := onAlertGroup(data); err != nil {
+				t.Fatal(err)
+			}
+
+			created := snClientMock.incidentsOf("CreateIncident")[0]
+			if got := created["major_incident_state"]; got != tt.want {
+				t.Errorf("Unexpected major_incident_state: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnAlertGroup_CreateWithoutSysID(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	data := template.Data{
+		Status:      "firing",
+		GroupLabels: template.KV{"alertname": "missing_sys_id"},
+	}
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", map[string]string{"number": "INC42"}).Return([]Incident{Incident{"number": "INC42", "sys_id": "42"}}, nil)
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{"number": "INC42"}, nil)
+
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertCalled(t, "GetIncidents", map[string]string{"number": "INC42"})
+
+	snClientMock = new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{}, nil)
+
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNumberOfCalls(t, "GetIncidents", 1)
+}
+
+func TestOnAlertGroup_CreateWorkNote(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.CreateWorkNote = "Created from group {{ .GroupLabels.alertname }}"
+	defer func() { config.Workflow.CreateWorkNote = "" }()
+	data := template.Data{
+		Status:      "firing",
+		GroupLabels: template.KV{"alertname": "create_work_note"},
+	}
+
+	snClientMock := mockServiceNow()
+
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+
+	created := snClientMock.incidentsOf("CreateIncident")[0]
+	if got, want := created["work_notes"], "Created from group create_work_note"; got != want {
+		t.Errorf("Unexpected work_notes: got %v, want %v", got, want)
+	}
+	if comments, _ := created["comments"].(string); !strings.HasPrefix(comments, "Alerts list:") {
+		t.Errorf("Unexpected comments: got %v", created["comments"])
+	}
+
+	snClientMock = new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{{"state": "2", "number": "INC42", "sys_id": "42"}}, nil)
+	snClientMock.On("UpdateIncident", mock.Anything, "42").Return(Incident{}, nil)
+
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := snClientMock.incidentsOf("UpdateIncident")[0]
+	if _, ok := updated["work_notes"]; ok {
+		t.Errorf("Unexpected work_notes on update: got %v", updated["work_notes"])
+	}
+}
+
+func TestOnAlertGroup_DeescalateOnPartialResolve(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.DeescalateOnPartialResolve = DeescalationConfig{Impact: "3", Urgency: "1"}
+	defer func() { config.Workflow.DeescalateOnPartialResolve = DeescalationConfig{} }()
+
+	update := func(firing int) Incident {
+		data := template.Data{
+			Status:      "firing",
+			GroupLabels: template.KV{"alertname": "deescalate"},
+		}
+		for i := 0; i < firing; i++ {
+			data.Alerts = append(data.Alerts, template.Alert{Status: "firing"})
+		}
+
+		snClientMock := mockServiceNow(Incident{"state": "2", "number": "INC42", "sys_id": "42", "impact": "1", "urgency": "2"})
+
+		if err := onAlertGroup(data); err != nil {
+			t.Fatal(err)
+		}
+		return snClientMock.incidentsOf("UpdateIncident")[0]
+	}
+
+	if got := update(3); got["impact"] != nil {
+		t.Errorf("Unexpected impact on first update: got %v", got["impact"])
+	}
+	if got := update(3); got["impact"] != nil {
+		t.Errorf("Unexpected impact with a stable firing count: got %v", got["impact"])
+	}
+	got := update(2)
+	if got["impact"] != "3" {
+		t.Errorf("Unexpected impact after a drop of firing alerts: got %v, want 3", got["impact"])
+	}
+	if got["urgency"] != nil {
+		t.Errorf("Unexpected urgency increase: got %v", got["urgency"])
+	}
+
+	// The firing count of a group not notified within the TTL is forgotten
+	defer func() { now = time.Now }()
+	later := time.Now().Add(firingCountTTL)
+	now = func() time.Time { return later }
+	if got := update(1); got["impact"] != nil {
+		t.Errorf("Unexpected impact after the firing count expired: got %v", got["impact"])
+	}
+}
+
+func TestOnAlertGroup_DedupWorkNotes(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.DefaultIncident["work_notes"] = "Alert {{ .Status }}"
+	incidentUpdateFields["work_notes"] = true
+	config.Workflow.DedupWorkNotes = true
+	defer func() { config.Workflow.DedupWorkNotes = false }()
+
+	data := template.Data{
+		Status:      "firing",
+		GroupLabels: template.KV{"alertname": "dedup_work_notes"},
+	}
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{Incident{"state": "1", "number": "INC42", "sys_id": "42"}}, nil)
+	snClientMock.On("GetLatestJournalEntry", "42", "work_notes").Return("Alert firing", nil)
+	snClientMock.On("UpdateIncident", mock.Anything, "42").Run(func(args mock.Arguments) {
+		incident := args.Get(0).(Incident)
+		if _, ok := incident["work_notes"]; ok {
+			t.Errorf("Duplicate work note should not be sent")
+		}
+	}).Return(Incident{}, nil)
+
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 1)
+}
+
+func TestOnAlertGroup_SkipDuplicateComments(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.DefaultIncident["comments"] = "Alert {{ .Status }}"
+	incidentUpdateFields["comments"] = true
+	config.Workflow.SkipDuplicateComments = true
+	defer loadConfig("test/servicenow_test.yml")
+
+	data := template.Data{
+		Status:      "firing",
+		GroupLabels: template.KV{"alertname": "skip_duplicate_comments"},
+	}
+
+	tests := []struct {
+		existing string
+		wantSent bool
+	}{
+		{existing: "Alert firing", wantSent: false},
+		{existing: "Alert resolved", wantSent: true},
+		{existing: "", wantSent: true},
+	}
+	for _, tt := range tests {
+		snClientMock := mockServiceNow(Incident{"state": "1", "number": "INC42", "sys_id": "42", "comments": tt.existing})
+
+		if err := onAlertGroup(data); err != nil {
+			t.Fatal(err)
+		}
+		incident := snClientMock.incidentsOf("UpdateIncident")[0]
+		if _, sent := incident["comments"]; sent != tt.wantSent {
+			t.Errorf("Unexpected comments update for existing comments %q: got sent %v, want %v", tt.existing, sent, tt.wantSent)
+		}
+	}
+}
+
+func TestOnAlertGroup_CreateOnlyFields(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.DefaultIncident["u_first_seen"] = "{{ .Status }} first"
+	config.DefaultIncident["u_last_seen"] = "{{ .Status }} last"
+	incidentUpdateFields["u_first_seen"] = true
+	incidentUpdateFields["u_last_seen"] = true
+	createOnlyFields["u_first_seen"] = true
+	incidentTemplates = compileIncidentTemplates(config.DefaultIncident)
+	defer loadConfig("test/servicenow_test.yml")
+
+	data := template.Data{Status: "firing", GroupLabels: template.KV{"alertname": "create_only_fields"}}
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil).Once()
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{"number": "INC42", "sys_id": "42"}, nil)
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	created := snClientMock.incidentsOf("CreateIncident")[0]
+	if created["u_first_seen"] != "firing first" || created["u_last_seen"] != "firing last" {
+		t.Errorf("Unexpected created incident: %v", created)
+	}
+
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{{"state": "1", "number": "INC42", "sys_id": "42"}}, nil)
+	snClientMock.On("UpdateIncident", mock.Anything, "42").Return(Incident{}, nil)
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	updated := snClientMock.incidentsOf("UpdateIncident")[0]
+	if _, ok := updated["u_first_seen"]; ok {
+		t.Errorf("Create-only field should not be updated: %v", updated)
+	}
+	if updated["u_last_seen"] != "firing last" {
+		t.Errorf("Unexpected updated incident: %v", updated)
+	}
+}
+
+func TestOnAlertGroup_IdempotencyKey(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.IdempotencyKeyField = "u_idempotency_key"
+	now = func() time.Time { return time.Unix(600, 0) }
+	defer func() {
+		config.Workflow.IdempotencyKeyField = ""
+		now = time.Now
+	}()
+
+	data := template.Data{
+		Status:      "firing",
+		GroupLabels: template.KV{"alertname": "idempotency"},
+	}
+	key := getGroupKey(data) + "-2"
+	keyParams := map[string]string{"u_idempotency_key": key}
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", keyParams).Return([]Incident{}, nil).Once()
+	snClientMock.On("GetIncidents", keyParams).Return([]Incident{Incident{"state": "6", "number": "INC42", "sys_id": "42"}}, nil)
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
+	snClientMock.On("CreateIncident", mock.Anything).Run(func(args mock.Arguments) {
+		incident := args.Get(0).(Incident)
+		if got := incident["u_idempotency_key"]; got != key {
+			t.Errorf("Wrong idempotency key: got %v, want %v", got, key)
+		}
+	}).Return(Incident{"number": "INC42", "sys_id": "42"}, nil)
+
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNumberOfCalls(t, "CreateIncident", 1)
+}
+
+func TestOnAlertGroup_ExistingIncidentTemplate(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.DefaultIncident["comments"] = "Updated {{ .Existing.number }} from state {{ .Existing.state }}"
+
+	data := template.Data{
+		Status:      "firing",
+		GroupLabels: template.KV{"alertname": "existing"},
+	}
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{Incident{"state": "2", "number": "INC42", "sys_id": "42"}}, nil)
+	snClientMock.On("UpdateIncident", mock.Anything, "42").Run(func(args mock.Arguments) {
+		incident := args.Get(0).(Incident)
+		want := "Updated INC42 from state 2"
+		if got := incident["comments"]; got != want {
+			t.Errorf("Unexpected comments: got %v, want %v", got, want)
+		}
+	}).Return(Incident{}, nil)
+
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 1)
+}
+
+func TestGetIncidentsParams(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+
+	got := getIncidentsParams("abc")
+	want := map[string]string{"short_description": "abc"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected params: got %v, want %v", got, want)
+	}
+
+	config.Workflow.SearchStates = []json.Number{"1", "2", "3"}
+	defer func() { config.Workflow.SearchStates = nil }()
+
+	got = getIncidentsParams("abc")
+	want = map[string]string{"sysparm_query": "short_description=abc^stateIN1,2,3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected params: got %v, want %v", got, want)
+	}
+}
+
+func TestGetGroupKey_Stable(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	want := "321c5b116cd164572538264a058b095f"
+
+	for i := 0; i < 20; i++ {
+		labels := template.KV{}
+		for _, name := range rand.Perm(3) {
+			switch name {
+			case 0:
+				labels["env"] = "prod"
+			case 1:
+				labels["instance"] = "test_instance:9100"
+			case 2:
+				labels["alertname"] = "something_happened"
+			}
+		}
+		if got := getGroupKey(template.Data{GroupLabels: labels}); got != want {
+			t.Fatalf("Unexpected group key: got %v, want %v", got, want)
+		}
+	}
+
+	labels := template.KV{"alertname": "something_happened", "env": "prod", "instance": "test_instance:9100"}
+	if got, want := canonicalLabels(labels), fmt.Sprintf("%v", labels.SortedPairs()); got != want {
+		t.Errorf("Unexpected canonical labels: got %v, want %v", got, want)
+	}
+}
+
+func TestGetGroupKey_DiscriminatorLabel(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	prod := template.Data{
+		GroupLabels:  template.KV{"alertname": "something_happened"},
+		CommonLabels: template.KV{"alertname": "something_happened", "env": "prod"},
+	}
+	dev := template.Data{
+		GroupLabels:  template.KV{"alertname": "something_happened"},
+		CommonLabels: template.KV{"alertname": "something_happened", "env": "dev"},
+	}
+
+	if getGroupKey(prod) != getGroupKey(dev) {
+		t.Errorf("Group keys should be identical without discriminator label")
+	}
+
+	config.Workflow.GroupKeyDiscriminatorLabel = "env"
+	defer func() { config.Workflow.GroupKeyDiscriminatorLabel = "" }()
+
+	if getGroupKey(prod) == getGroupKey(dev) {
+		t.Errorf("Group keys should be different with discriminator label")
+	}
+}
+
+func TestGetGroupKey_TemplatedValue(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.IncidentGroupKeyField = "u_group_key"
+	config.Workflow.IncidentGroupKeyValue = "{{ .GroupLabels.alertname }}/{{ .CommonLabels.env }}"
+	defer loadConfig("test/servicenow_test.yml")
+
+	data := template.Data{
+		Status:       "firing",
+		GroupLabels:  template.KV{"alertname": "NodeDown"},
+		CommonLabels: template.KV{"alertname": "NodeDown", "env": "prod"},
+	}
+	if got, want := getGroupKey(data), "NodeDown/prod"; got != want {
+		t.Errorf("Unexpected group key: got %v, want %v", got, want)
+	}
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", map[string]string{"u_group_key": "NodeDown/prod"}).Return([]Incident{}, nil)
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{"number": "INC42", "sys_id": "42"}, nil)
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	created := snClientMock.incidentsOf("CreateIncident")[0]
+	if got := created["u_group_key"]; got != "NodeDown/prod" {
+		t.Errorf("Unexpected created group key: got %v, want %v", got, "NodeDown/prod")
+	}
+
+	config.Workflow.IncidentGroupKeyValue = "{{ .CommonLabels.missing }}"
+	delete(data.CommonLabels, "env")
+	if got, want := getGroupKey(data), groupLabelsHash(data); got != want {
+		t.Errorf("Unexpected fallback group key: got %v, want %v", got, want)
+	}
+
+	// A key that would alter the encoded query is not used
+	config.Workflow.IncidentGroupKeyValue = "{{ .CommonLabels.alertname }}"
+	data.CommonLabels["alertname"] = "NodeDown^ORactive=true"
+	if got, want := getGroupKey(data), groupLabelsHash(data); got != want {
+		t.Errorf("Unexpected group key with a ^: got %v, want %v", got, want)
+	}
+
+	// The rendered key is not templated again
+	data.CommonLabels["alertname"] = "{{ .Status }}"
+	if incident, _ := alertGroupToIncident(data, nil); incident["u_group_key"] != "{{ .Status }}" {
+		t.Errorf("Unexpected templated group key: got %v", incident["u_group_key"])
+	}
+}
+
+func TestOnAlertGroup_ExpectedNumberPrefix(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.ExpectedNumberPrefix = "INC"
+	defer func() { config.Workflow.ExpectedNumberPrefix = "" }()
+
+	data := template.Data{
+		Status:      "firing",
+		GroupLabels: template.KV{"alertname": "number_prefix"},
+	}
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{"number": "CHG0042", "sys_id": "42"}, nil)
+
+	before := testutil.ToFloat64(serviceNowUnexpectedNumberPrefix)
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(serviceNowUnexpectedNumberPrefix) - before; got != 1 {
+		t.Errorf("Wrong unexpected number prefix count: got %v, want %v", got, 1)
+	}
+
+	if !checkNumberPrefix(Incident{"number": "INC0042"}) {
+		t.Errorf("Number INC0042 should match the expected prefix")
+	}
+}
+
+func TestNextUpdateCount(t *testing.T) {
+	config.Workflow.UpdateCountField = "u_alert_update_count"
+	defer func() { config.Workflow.UpdateCountField = "" }()
+
+	tests := []struct {
+		name     string
+		incident Incident
+		want     string
+	}{
+		{name: "missing", incident: Incident{}, want: "1"},
+		{name: "non_numeric", incident: Incident{"u_alert_update_count": "abc"}, want: "1"},
+		{name: "numeric", incident: Incident{"u_alert_update_count": "4"}, want: "5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextUpdateCount(tt.incident); got != tt.want {
+				t.Errorf("nextUpdateCount() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookHandler_Signature(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Web.HMACSecret = "secret"
+	defer func() { config.Web.HMACSecret = "" }()
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{}, nil)
+
+	data, err := ioutil.ReadFile("test/alertmanager_firing.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(data)
+
+	tests := []struct {
+		name      string
+		signature string
+		want      int
+	}{
+		{name: "valid", signature: hex.EncodeToString(mac.Sum(nil)), want: http.StatusOK},
+		{name: "invalid", signature: hex.EncodeToString([]byte("forged")), want: http.StatusUnauthorized},
+		{name: "missing", signature: "", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/webhook", bytes.NewReader(data))
+			if len(tt.signature) > 0 {
+				req.Header.Set("X-Signature", tt.signature)
+			}
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(webhook).ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.want {
+				t.Errorf("Wrong status code: got %v, want %v", status, tt.want)
+			}
+		})
+	}
+	snClientMock.AssertNumberOfCalls(t, "CreateIncident", 1)
+
+	// A compressed body is signed as sent
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Write(data)
+	gzipWriter.Close()
+	mac = hmac.New(sha256.New, []byte("secret"))
+	mac.Write(compressed.Bytes())
+	req := httptest.NewRequest("POST", "/webhook", bytes.NewReader(compressed.Bytes()))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(webhook).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Wrong status code of a signed compressed body: got %v, want %v", status, http.StatusOK)
+	}
+}
+
+func TestSeparateServeMuxes(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	webhookMux, metricsMux := newSeparateServeMuxes()
+	webhookServer := httptest.NewServer(webhookMux)
+	defer webhookServer.Close()
+	metricsServer := httptest.NewServer(metricsMux)
+	defer metricsServer.Close()
+
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{url: metricsServer.URL + "/metrics", want: http.StatusOK},
+		{url: metricsServer.URL + "/healthz", want: http.StatusOK},
+		{url: webhookServer.URL + "/metrics", want: http.StatusNotFound},
+		{url: webhookServer.URL + "/healthz", want: http.StatusNotFound},
+		{url: webhookServer.URL + "/", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("Wrong status code for %s: got %v, want %v", tt.url, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestServeMux_RateLimit(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Web.RateLimit = 1
+	config.Web.RateLimitBurst = 2
+	defer func() { config.Web = WebConfig{} }()
+	current := time.Unix(600, 0)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	mux := newServeMux()
+	status := func(method string, url string) int {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, url, strings.NewReader("{")))
+		return rr.Code
+	}
+
+	before := testutil.ToFloat64(webhookRateLimited)
+	var got []int
+	for i := 0; i < 4; i++ {
+		got = append(got, status("POST", "/webhook"))
+	}
+	want := []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusTooManyRequests, http.StatusTooManyRequests}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected status codes: got %v, want %v", got, want)
+	}
+	if limited := testutil.ToFloat64(webhookRateLimited) - before; limited != 2 {
+		t.Errorf("Unexpected webhook_rate_limited_total increase: got %v, want 2", limited)
+	}
+
+	for _, url := range []string{"/metrics", "/healthz"} {
+		if got := status("GET", url); got != http.StatusOK {
+			t.Errorf("Unexpected status code for %s: got %v, want %v", url, got, http.StatusOK)
+		}
+	}
+
+	current = current.Add(time.Second)
+	if got := status("POST", "/webhook"); got != http.StatusBadRequest {
+		t.Errorf("Unexpected status code after refill: got %v, want %v", got, http.StatusBadRequest)
+	}
+}
+
+func TestServeMux_RateLimitAfterAuthentication(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Web.BearerToken = "secret"
+	config.Web.RateLimit = 1
+	config.Web.RateLimitBurst = 2
+	defer func() { config.Web = WebConfig{} }()
+	current := time.Unix(600, 0)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	mux := newServeMux()
+	status := func(token string) int {
+		req := httptest.NewRequest("POST", "/webhook", strings.NewReader("{"))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Rejected requests do not use up the tokens of authenticated ones
+	for i := 0; i < 5; i++ {
+		if got := status("wrong"); got != http.StatusUnauthorized {
+			t.Errorf("Unexpected status code without authentication: got %v, want %v", got, http.StatusUnauthorized)
+		}
+	}
+	var got []int
+	for i := 0; i < 3; i++ {
+		got = append(got, status("secret"))
+	}
+	if want := []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusTooManyRequests}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected status codes of authenticated requests: got %v, want %v", got, want)
+	}
+}
+
+func TestServeMux_WarmUp(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	atomic.StoreInt32(&warmingUp, 1)
+	defer atomic.StoreInt32(&warmingUp, 0)
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("CheckHealth").Return(nil)
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
+
+	mux := newServeMux()
+	status := func(method string, url string) int {
+		rr := httptest.NewRecorder()
+		body := `{"status": "resolved", "groupLabels": {"alertname": "warm_up"}}`
+		mux.ServeHTTP(rr, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return rr.Code
+	}
+
+	for _, url := range []string{"/webhook", "/healthz"} {
+		if got := status("POST", url); got != http.StatusServiceUnavailable {
+			t.Errorf("Unexpected status code for %s during warm-up: got %v, want %v", url, got, http.StatusServiceUnavailable)
+		}
+	}
+	snClientMock.AssertNotCalled(t, "GetIncidents", mock.Anything)
+
+	warmUp(time.Millisecond)
+
+	for _, url := range []string{"/webhook", "/healthz"} {
+		if got := status("POST", url); got != http.StatusOK {
+			t.Errorf("Unexpected status code for %s after warm-up: got %v, want %v", url, got, http.StatusOK)
+		}
+	}
+}
+
+func TestWebhookHandler_Buffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.BufferDir = dir
+	config.Workflow.BufferMaxSize = 2
+	defer func() {
+		loadConfig("test/servicenow_test.yml")
+		atomic.StoreInt32(&serviceNowDown, 0)
+		setBufferDepth(0)
+	}()
+	if err := openBuffer(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("CheckHealth").Return(errors.New("ServiceNow is in maintenance")).Once()
+	checkHealth()
+
+	post := func(alertname string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"status": "firing", "groupLabels": {"alertname": "%s"}}`, alertname)
+		webhook(rr, httptest.NewRequest("POST", "/webhook", strings.NewReader(body)))
+		return rr
+	}
+
+	// Buffering while ServiceNow is unavailable
+	for _, alertname := range []string{"first", "second"} {
+		if rr := post(alertname); rr.Code != http.StatusOK || rr.Body.String() != `{"status":200,"message":"Buffered"}` {
+			t.Errorf("Unexpected response while ServiceNow is unavailable: got %v %v", rr.Code, rr.Body.String())
+		}
+	}
+	if rr := post("third"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status code when the buffer is full: got %v, want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+	if got := testutil.ToFloat64(webhookBufferDepth); got != 2 {
+		t.Errorf("Wrong webhook_buffer_queue_depth: got %v, want %v", got, 2)
+	}
+	snClientMock.AssertNotCalled(t, "GetIncidents", mock.Anything)
+
+	// Replay on recovery, in order
+	snClientMock.On("CheckHealth").Return(nil)
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{}, nil)
+	checkHealth()
+
+	snClientMock.AssertNumberOfCalls(t, "CreateIncident", 2)
+	var created []string
+	for _, call := range snClientMock.Calls {
+		if call.Method == "CreateIncident" {
+			created = append(created, call.Arguments.Get(0).(Incident)["short_description"].(string))
+		}
+	}
+	first := getGroupKey(template.Data{GroupLabels: template.KV{"alertname": "first"}})
+	second := getGroupKey(template.Data{GroupLabels: template.KV{"alertname": "second"}})
+	if created[0] != first || created[1] != second {
+		t.Errorf("Unexpected replay order: got %v", created)
+	}
+	if files, _ := bufferedFiles(dir); len(files) != 0 {
+		t.Errorf("Unexpected buffered alert groups left after replay: %v", files)
+	}
+	if got := testutil.ToFloat64(webhookBufferDepth); got != 0 {
+		t.Errorf("Wrong webhook_buffer_queue_depth: got %v, want %v", got, 0)
+	}
+	if isBuffering() {
+		t.Errorf("Alert groups should not be buffered anymore after replay")
+	}
+}
+
+func TestReplayBuffer_DeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.BufferDir = dir
+	defer func() {
+		loadConfig("test/servicenow_test.yml")
+		setBufferDepth(0)
+	}()
+	if err := openBuffer(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	groups := []template.Data{}
+	for _, alertname := range []string{"rejected", "unavailable", "replayed"} {
+		groups = append(groups, template.Data{Status: "firing", GroupLabels: template.KV{"alertname": alertname}})
+	}
+	if err := bufferAlertGroups(groups); err != nil {
+		t.Fatal(err)
+	}
+	params := func(group template.Data) map[string]string {
+		return getIncidentsParams(getGroupKey(group))
+	}
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", params(groups[0])).Return([]Incident{}, errors.New("ServiceNow returned the HTTP error code: 400"))
+	snClientMock.On("GetIncidents", params(groups[1])).Return([]Incident{}, unavailableError{errors.New("ServiceNow returned the HTTP error code: 503")}).Once()
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
+	snClientMock.On("CreateIncident", mock.Anything).Return(Incident{"number": "INC42", "sys_id": "42"}, nil)
+
+	// A rejected alert group is moved aside, while an unavailable ServiceNow stops the replay
+	before := testutil.ToFloat64(webhookBufferDeadLetters)
+	replayBuffer()
+	if got := testutil.ToFloat64(webhookBufferDeadLetters) - before; got != 1 {
+		t.Errorf("Unexpected webhook_buffer_dead_letters_total increase: got %v, want 1", got)
+	}
+	if files, _ := bufferedFiles(filepath.Join(dir, bufferDeadLetterDir)); len(files) != 1 {
+		t.Errorf("Unexpected dead letters: got %v, want 1 file", files)
+	}
+	if files, _ := bufferedFiles(dir); len(files) != 2 {
+		t.Errorf("Unexpected buffered alert groups after an unavailability: got %v, want 2 files", files)
+	}
+	snClientMock.AssertNotCalled(t, "CreateIncident", mock.Anything)
+
+	replayBuffer()
+	if files, _ := bufferedFiles(dir); len(files) != 0 {
+		t.Errorf("Unexpected buffered alert groups left after replay: %v", files)
+	}
+	snClientMock.AssertNumberOfCalls(t, "CreateIncident", 2)
+}
+
+func TestReplayBuffer_MaintenancePage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.BufferDir = dir
+	defer func() {
+		loadConfig("test/servicenow_test.yml")
+		setBufferDepth(0)
+	}()
+	if err := openBuffer(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := bufferAlertGroups([]template.Data{{Status: "firing", GroupLabels: template.KV{"alertname": "maintenance"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html>ServiceNow is under maintenance</html>")
+	}))
+	defer ts.Close()
+	snClient, err := NewServiceNowClientWithBaseURL(ts.URL, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceNow = snClient
+
+	// A maintenance page stops the replay, like any unavailability
+	before := testutil.ToFloat64(webhookBufferDeadLetters)
+	replayBuffer()
+	if got := testutil.ToFloat64(webhookBufferDeadLetters) - before; got != 0 {
+		t.Errorf("Unexpected webhook_buffer_dead_letters_total increase: got %v, want 0", got)
+	}
+	if files, _ := bufferedFiles(dir); len(files) != 1 {
+		t.Errorf("Unexpected buffered alert groups after a maintenance page: got %v, want 1 file", files)
+	}
+}
+
+func TestAdminResolve(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Web.BearerToken = "secret"
+	config.Workflow.CloseFields = map[string]string{"state": "6"}
+	defer func() {
+		config.Web = WebConfig{}
+		config.Workflow.CloseFields = nil
+	}()
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	groupKey := getGroupKey(template.Data{GroupLabels: template.KV{"alertname": "storm"}})
+	snClientMock.On("GetIncidents", map[string]string{"short_description": groupKey}).Return([]Incident{
+		{"state": "2", "number": "INC41", "sys_id": "41"},
+		{"state": "7", "number": "INC42", "sys_id": "42"},
+	}, nil)
+	snClientMock.On("UpdateIncident", mock.Anything, "41").Return(Incident{}, nil)
+
+	mux := newServeMux()
+	resolve := func(body string, token string) int {
+		req := httptest.NewRequest("POST", "/admin/resolve", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if got := resolve(`{"labels": {"alertname": "storm"}, "confirm": true}`, "wrong"); got != http.StatusUnauthorized {
+		t.Errorf("Unexpected status code without authentication: got %v, want %v", got, http.StatusUnauthorized)
+	}
+	if got := resolve(`{"labels": {"alertname": "storm"}}`, "secret"); got != http.StatusBadRequest {
+		t.Errorf("Unexpected status code without confirmation: got %v, want %v", got, http.StatusBadRequest)
+	}
+	if got := resolve(`{"group_key": "x^NQstate!=7", "confirm": true}`, "secret"); got != http.StatusBadRequest {
+		t.Errorf("Unexpected status code with a ^ in the group key: got %v, want %v", got, http.StatusBadRequest)
+	}
+	snClientMock.AssertNotCalled(t, "GetIncidents", mock.Anything)
+	snClientMock.AssertNotCalled(t, "UpdateIncident", mock.Anything, mock.Anything)
+
+	if got := resolve(`{"labels": {"alertname": "storm"}, "confirm": true}`, "secret"); got != http.StatusOK {
+		t.Errorf("Unexpected status code: got %v, want %v", got, http.StatusOK)
+	}
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 1)
+	update := snClientMock.incidentsOf("UpdateIncident")[0]
+	if update["state"] != "6" || update["closed_by"] != "prometheus_integration" {
+		t.Errorf("Unexpected close fields: got %v", update)
+	}
+
+	// The tables of table_by_severity are searched too
+	config.Workflow.TableBySeverity = map[string]string{"warning": "u_alert_log"}
+	defer func() { config.Workflow.TableBySeverity = nil }()
+	snClientMock.On("GetIncidentsInTable", map[string]string{"short_description": groupKey}, "u_alert_log").Return([]Incident{{"state": "2", "number": "ALG43", "sys_id": "43"}}, nil)
+	snClientMock.On("UpdateIncidentInTable", mock.Anything, "43", "u_alert_log").Return(Incident{}, nil)
+	if got := resolve(`{"labels": {"alertname": "storm"}, "confirm": true}`, "secret"); got != http.StatusOK {
+		t.Errorf("Unexpected status code: got %v, want %v", got, http.StatusOK)
+	}
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncident", 2)
+	snClientMock.AssertNumberOfCalls(t, "UpdateIncidentInTable", 1)
+}
+
+func TestServeMux_ProtectMetrics(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+
+	rr := httptest.NewRecorder()
+	newServeMux().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusOK)
+	}
+
+	config.Web.BearerToken = "token"
+	config.Web.ProtectMetrics = true
+	defer func() { config.Web = WebConfig{} }()
+
+	rr = httptest.NewRecorder()
+	newServeMux().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusUnauthorized)
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	rr = httptest.NewRecorder()
+	newServeMux().ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusOK)
+	}
+
+	// The token must be sent with the Bearer scheme
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "token")
+	rr = httptest.NewRecorder()
+	newServeMux().ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("Wrong status code without the Bearer scheme: got %v, want %v", status, http.StatusUnauthorized)
+	}
+}
+
+func TestLoadConfigContent_IncompleteBasicAuth(t *testing.T) {
+	defer loadConfig("test/servicenow_test.yml")
+	configContent, err := ioutil.ReadFile("test/servicenow_test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configContent = append(configContent, []byte("web:\n  basic_auth:\n    password: secret\n  protect_metrics: true\n")...)
+	_, err = loadConfigContent(configContent)
+	if err == nil || !strings.Contains(err.Error(), "basic_auth requires both user_name and password") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if strings.Contains(err.Error(), "protect_metrics") {
+		t.Errorf("A password only basic_auth should count as configured auth: %v", err)
+	}
+}
+
+func TestServeMux_WebhookBasicAuth(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Web.BasicAuth = BasicAuthConfig{UserName: "alertmanager", Password: "secret"}
+	defer func() { config.Web = WebConfig{} }()
+
+	rr := httptest.NewRecorder()
+	newServeMux().ServeHTTP(rr, httptest.NewRequest("POST", "/webhook", nil))
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusUnauthorized)
+	}
+
+	req := httptest.NewRequest("POST", "/webhook", nil)
+	req.SetBasicAuth("alertmanager", "secret")
+	rr = httptest.NewRecorder()
+	newServeMux().ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusBadRequest)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	var buf bytes.Buffer
+	accessLogger = log.NewLogger(&buf)
+	defer func() { accessLogger = log.Base() }()
+
+	req := httptest.NewRequest("POST", "/webhook", nil)
+	req.Header.Set("X-Request-Id", "42")
+	rr := httptest.NewRecorder()
+	accessLog(newServeMux()).ServeHTTP(rr, req)
+
+	for _, want := range []string{"method=POST", "path=/webhook", "status=400", "duration=", "remote_addr=", "request_id=42"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Access log %q does not contain %q", buf.String(), want)
+		}
+	}
+}
+
+func TestWebhook_ProcessingTimeout(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.ProcessingTimeout = 10 * time.Millisecond
+	defer func() { config.Workflow.ProcessingTimeout = 0 }()
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).After(100*time.Millisecond).Return([]Incident{}, nil).Once()
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, nil)
+
+	before := testutil.ToFloat64(webhookProcessingTimeouts)
+	body := `{"status": "resolved", "groupLabels": {"alertname": "processing_timeout"}}`
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(webhook).ServeHTTP(rr, httptest.NewRequest("POST", "/webhook", strings.NewReader(body)))
+
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("Unexpected status code: got %v, want %v", rr.Code, http.StatusGatewayTimeout)
+	}
+	if got := testutil.ToFloat64(webhookProcessingTimeouts) - before; got != 1 {
+		t.Errorf("Unexpected webhook_processing_timeouts_total increase: got %v, want 1", got)
+	}
+
+	// A retry is not processed while the background processing goes on
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(webhook).ServeHTTP(rr, httptest.NewRequest("POST", "/webhook", strings.NewReader(body)))
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("Unexpected status code of the retry: got %v, want %v", rr.Code, http.StatusGatewayTimeout)
+	}
+	snClientMock.AssertNumberOfCalls(t, "GetIncidents", 1)
+
+	time.Sleep(200 * time.Millisecond)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(webhook).ServeHTTP(rr, httptest.NewRequest("POST", "/webhook", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Unexpected status code once the background processing completed: got %v, want %v", rr.Code, http.StatusOK)
+	}
+	snClientMock.AssertNumberOfCalls(t, "GetIncidents", 2)
+}
+
+func TestWebhook_EmptyGroupLabelsStrategy(t *testing.T) {
+	body := `{"status": "firing", "groupLabels": {}, "alerts": [
+		{"status": "firing", "labels": {"alertname": "NodeDown", "instance": "server01"}},
+		{"status": "firing", "labels": {"alertname": "NodeDown", "instance": "server02"}}]}`
+
+	tests := []struct {
+		strategy    string
+		wantCode    int
+		wantCreates int
+	}{
+		{strategy: "single", wantCode: http.StatusOK, wantCreates: 1},
+		{strategy: "per_alert", wantCode: http.StatusOK, wantCreates: 2},
+		{strategy: "error", wantCode: http.StatusBadRequest, wantCreates: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			loadConfig("test/servicenow_test.yml")
+			config.Workflow.EmptyGroupLabelsStrategy = tt.strategy
+			defer func() { config.Workflow.EmptyGroupLabelsStrategy = "" }()
+
+			snClientMock := mockServiceNow()
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(webhook).ServeHTTP(rr, httptest.NewRequest("POST", "/webhook", strings.NewReader(body)))
+			if rr.Code != tt.wantCode {
+				t.Errorf("Unexpected status code: got %v, want %v", rr.Code, tt.wantCode)
+			}
+			snClientMock.AssertNumberOfCalls(t, "CreateIncident", tt.wantCreates)
+
+			groupKeys := map[string]bool{}
+			for _, call := range snClientMock.Calls {
+				if call.Method == "CreateIncident" {
+					groupKeys[call.Arguments.Get(0).(Incident)["short_description"].(string)] = true
+				}
+			}
+			if len(groupKeys) != tt.wantCreates {
+				t.Errorf("Unexpected distinct group keys: got %v, want %d", groupKeys, tt.wantCreates)
+			}
+		})
+	}
+}
+
+func TestWebhook_LogSample(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	var buf bytes.Buffer
+	requestLogger = log.NewLogger(&buf)
+	sample := *logSample
+	*logSample = 3
+	defer func() {
+		requestLogger = log.Base()
+		*logSample = sample
+	}()
+	atomic.StoreUint64(&sampledLines, 0)
+
+	snClientMock := new(MockedSnClient)
+	serviceNow = snClientMock
+	snClientMock.On("GetIncidents", mock.Anything).Return([]Incident{}, errors.New("ServiceNow is down"))
+
+	body := `{"status": "firing", "groupLabels": {"alertname": "log_sample"}}`
+	for i := 0; i < 6; i++ {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(webhook).ServeHTTP(rr, httptest.NewRequest("POST", "/webhook", strings.NewReader(body)))
+	}
+
+	if got := strings.Count(buf.String(), "Received alert group"); got != 2 {
+		t.Errorf("Unexpected number of sampled info lines: got %d, want 2", got)
+	}
+	if got := strings.Count(buf.String(), "Error managing incident"); got != 6 {
+		t.Errorf("Unexpected number of error lines: got %d, want 6", got)
+	}
+}
+
+func TestApplyTemplate_emptyText(t *testing.T) {
+	data := template.Data{}
+	text := ""
+	got, err := applyTemplate("name", text, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ""
+	if got != want {
+		t.Errorf("Unexpected result: got %v, want %v", got, want)
+	}
+}
+
+func TestApplyTemplate_OK(t *testing.T) {
+	data := template.Data{
+		Status: "firing",
+		CommonAnnotations: map[string]string{
+			"error": "my error",
+		},
+	}
+	text := "Status is {{.Status}} and error is {{.CommonAnnotations.error}}"
+	got, err := applyTemplate("name", text, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Status is firing and error is my error"
+	if string(got) != want {
+		t.Errorf("Unexpected result: got %v, want %v", got, want)
+	}
+}
+
+func TestApplyTemplate_GeneratorURL(t *testing.T) {
+	data := template.Data{
+		Alerts: template.Alerts{
+			{GeneratorURL: "https://prometheus.example.com/graph?g0.expr=up"},
+			{GeneratorURL: "https://prometheus.example.com/graph?g0.expr=down"},
+		},
+	}
+	text := "Source: {{ generatorURL .Alerts }}"
+	got, err := applyTemplate("name", text, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Source: https://prometheus.example.com/graph?g0.expr=up"
+	if got != want {
+		t.Errorf("Unexpected result: got %v, want %v", got, want)
+	}
+}
+
+func TestAlertGroupToIncident_SourceLinkField(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.SourceLinkField = "u_source_link"
+	defer func() { config.Workflow.SourceLinkField = "" }()
+
+	data := template.Data{
+		Alerts: template.Alerts{
+			{GeneratorURL: "https://prometheus.example.com/graph?g0.expr=up"},
+		},
+	}
+	incident, err := alertGroupToIncident(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := incident["u_source_link"]
+	want := "https://prometheus.example.com/graph?g0.expr=up"
+	if got != want {
+		t.Errorf("Unexpected result: got %v, want %v", got, want)
+	}
+}
+
+func TestAlertGroupToIncident_FieldFromLabel(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.FieldFromLabel = map[string]string{"assignment_group": "team", "u_service": "service"}
+	defer func() { config.Workflow.FieldFromLabel = nil }()
+
+	data := template.Data{
+		CommonLabels: template.KV{"team": "database"},
+	}
+	incident, err := alertGroupToIncident(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := incident["assignment_group"]; got != "database" {
+		t.Errorf("Unexpected assignment_group: got %v, want %v", got, "database")
+	}
+	if _, ok := incident["u_service"]; ok {
+		t.Errorf("Unexpected u_service field for a missing label: got %v", incident["u_service"])
+	}
+
+	// Label values are never executed as templates
+	data.CommonLabels["team"] = "{{ .Status }}x"
+	data.Status = "firing"
+	if incident, _ = alertGroupToIncident(data, nil); incident["assignment_group"] != "{{ .Status }}x" {
+		t.Errorf("Label value should not be templated: got %v", incident["assignment_group"])
+	}
+}
+
+func TestAlertGroupToIncident_GroupLabelFields(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.GroupLabelFields = map[string]string{"cluster": "u_cluster", "namespace": "u_namespace", "job": "u_job"}
+	defer func() { config.Workflow.GroupLabelFields = nil }()
+
+	data := template.Data{
+		GroupLabels: template.KV{"cluster": "prod-eu", "namespace": "billing"},
+	}
+	incident, err := alertGroupToIncident(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := incident["u_cluster"]; got != "prod-eu" {
+		t.Errorf("Unexpected u_cluster: got %v, want %v", got, "prod-eu")
+	}
+	if got := incident["u_namespace"]; got != "billing" {
+		t.Errorf("Unexpected u_namespace: got %v, want %v", got, "billing")
+	}
+	if _, ok := incident["u_job"]; ok {
+		t.Errorf("Unexpected u_job field for a missing label: got %v", incident["u_job"])
+	}
+
+	// Label values are never executed as templates
+	data.GroupLabels["namespace"] = "{{ .Status }}"
+	data.Status = "firing"
+	if incident, _ = alertGroupToIncident(data, nil); incident["u_namespace"] != "{{ .Status }}" {
+		t.Errorf("Label value should not be templated: got %v", incident["u_namespace"])
+	}
+}
+
+func TestAlertGroupToIncident_AssignmentGroupOrder(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.AssignmentGroupOrder = []string{"label:team", "lookup:service", "static:NOC"}
+	defer loadConfig("test/servicenow_test.yml")
+
+	var err error
+	lookupTables, err = loadLookupTables("test/lookup.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		labels template.KV
+		want   string
+	}{
+		{name: "label", labels: template.KV{"team": "database", "service": "api"}, want: "database"},
+		{name: "lookup", labels: template.KV{"service": "api"}, want: "API Team"},
+		{name: "static", labels: template.KV{"service": "unknown"}, want: "NOC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			incident, err := alertGroupToIncident(template.Data{CommonLabels: tt.labels}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := incident["assignment_group"]; got != tt.want {
+				t.Errorf("Unexpected assignment_group: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigContent_InvalidAssignmentGroupOrder(t *testing.T) {
+	configFile := `
+service_now:
+ instance_name: "instance"
+ user_name: "SA"
+ password: "SA!"
+workflow:
+ incident_group_key_field: "u_other_reference_1"
+ assignment_group_order: ["label:team", "config:team", "static:"]
+`
+	_, err := loadConfigContent([]byte(configFile))
+	defer loadConfig("test/servicenow_test.yml")
+	if err == nil || strings.Count(err.Error(), "assignment_group_order") != 2 {
+		t.Errorf("Expected errors for both invalid sources, got: %v", err)
+	}
+}
+
+func TestAlertGroupToIncident_ShortDescriptionFormat(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.IncidentGroupKeyField = "u_group_key"
+	config.Workflow.ShortDescriptionPrefix = "[PROM] "
+	config.Workflow.ShortDescriptionSuffix = " (prod)"
+	defer loadConfig("test/servicenow_test.yml")
+
+	data := template.Data{
+		GroupLabels: template.KV{"alertname": "NodeDown"},
+	}
+	incident, err := alertGroupToIncident(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := incident["short_description"], "[PROM] Alerts from group: alertname:NodeDown  (prod)"; got != want {
+		t.Errorf("Unexpected short_description: got %q, want %q", got, want)
+	}
+
+	config.Workflow.ShortDescriptionMaxLength = 31
+	incident, err = alertGroupToIncident(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := incident["short_description"], "[PROM] Alerts from group (prod)"; got != want {
+		t.Errorf("Unexpected truncated short_description: got %q, want %q", got, want)
+	}
+}
+
+func TestAlertGroupToIncident_DefaultShortDescriptionAnnotation(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.IncidentGroupKeyField = "u_group_key"
+	config.Workflow.DefaultShortDescriptionAnnotation = "summary"
+	delete(config.DefaultIncident, "short_description")
+	defer loadConfig("test/servicenow_test.yml")
+
+	incident, err := alertGroupToIncident(template.Data{CommonAnnotations: template.KV{"summary": "Disk is full"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := incident["short_description"], "Disk is full"; got != want {
+		t.Errorf("Unexpected short_description: got %v, want %v", got, want)
+	}
+
+	incident, err = alertGroupToIncident(template.Data{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := incident["short_description"], defaultShortDescription; got != want {
+		t.Errorf("Unexpected fallback short_description: got %v, want %v", got, want)
+	}
+}
+
+func TestAlertGroupToIncident_Transforms(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.DefaultIncident["impact"] = "{{ .CommonLabels.severity }}"
+	config.Workflow.Transforms = map[string][]string{
+		"impact":   {"trim", "lower", "map:critical=1,warning=2,info=3"},
+		"category": {"replace:Fail:Err", "upper"},
+	}
+	defer loadConfig("test/servicenow_test.yml")
+
+	incident, err := alertGroupToIncident(template.Data{CommonLabels: template.KV{"severity": " Critical"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := incident["impact"], "1"; got != want {
+		t.Errorf("Unexpected impact: got %v, want %v", got, want)
+	}
+	if got, want := incident["category"], "ERRURE"; got != want {
+		t.Errorf("Unexpected category: got %v, want %v", got, want)
+	}
+
+	incident, err = alertGroupToIncident(template.Data{CommonLabels: template.KV{"severity": "major"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := incident["impact"], "major"; got != want {
+		t.Errorf("Unexpected unmapped impact: got %v, want %v", got, want)
+	}
+}
+
+func TestLoadConfigContent_InvalidTransform(t *testing.T) {
+	configFile := `
+service_now:
+ instance_name: "instance"
+ user_name: "SA"
+ password: "SA!"
+workflow:
+ incident_group_key_field: "u_other_reference_1"
+ transforms:
+  impact: ["map:critical"]
+`
+	if _, err := loadConfigContent([]byte(configFile)); err == nil {
+		t.Errorf("Should have an error with an invalid transform")
+	}
+}
+
+func TestNewTemplateData_StripLabels(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	defer loadConfig("test/servicenow_test.yml")
+
+	data := template.Data{
+		CommonLabels: template.KV{"__name__": "up", "job": "node", "instance": "server01"},
+		Alerts:       template.Alerts{{Labels: template.KV{"__name__": "up", "job": "node", "instance": "server01"}}},
+	}
+	text := "{{ range .CommonLabels.SortedPairs }}{{ .Name }} {{ end }}/{{ range .Alerts }}{{ range .Labels.SortedPairs }}{{ .Name }} {{ end }}{{ end }}"
+
+	tests := []struct {
+		name          string
+		stripInternal *bool
+		denyList      []string
+		want          string
+	}{
+		{name: "default", want: "instance job /instance job "},
+		{name: "deny list", denyList: []string{"job"}, want: "instance /instance "},
+		{name: "opt-out", stripInternal: new(bool), want: "__name__ instance job /__name__ instance job "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Workflow.StripInternalLabels = tt.stripInternal
+			config.Workflow.LabelDenyList = tt.denyList
+
+			got, err := applyTemplate("labels", text, newTemplateData(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Unexpected labels: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if _, ok := data.CommonLabels["__name__"]; !ok {
+		t.Errorf("The original alert group labels should be left untouched")
+	}
+}
+
+func TestAlertGroupToIncident_PrometheusField(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.PrometheusField = "u_prometheus"
+	defer func() { config.Workflow.PrometheusField = "" }()
+
+	data := template.Data{
+		Alerts: template.Alerts{
+			{Labels: template.KV{"prometheus": "monitoring/k8s"}},
+			{Labels: template.KV{"prometheus": "monitoring/other"}},
+		},
+	}
+	incident, err := alertGroupToIncident(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := incident["u_prometheus"], "monitoring/k8s"; got != want {
+		t.Errorf("Unexpected u_prometheus: got %v, want %v", got, want)
+	}
+	if got, _ := applyTemplate("name", "{{ .Prometheus }}", newTemplateData(data)); got != "monitoring/k8s" {
+		t.Errorf("Unexpected .Prometheus: got %v, want %v", got, "monitoring/k8s")
+	}
+
+	config.Workflow.PrometheusLabel = "cluster"
+	defer func() { config.Workflow.PrometheusLabel = "" }()
+	incident, err = alertGroupToIncident(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := incident["u_prometheus"]; ok {
+		t.Errorf("Unexpected u_prometheus with a missing label: got %v", incident["u_prometheus"])
+	}
+}
+
+func TestAlertGroupToIncident_AlertCountField(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.AlertCountField = "u_active_alert_count"
+	defer func() { config.Workflow.AlertCountField = "" }()
+
+	data := template.Data{
+		Alerts: template.Alerts{{Status: "firing"}, {Status: "resolved"}, {Status: "firing"}},
+	}
+	incident, err := alertGroupToIncident(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(Incident{"u_active_alert_count": incident["u_active_alert_count"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(body), `{"u_active_alert_count":2}`; got != want {
+		t.Errorf("Unexpected serialized incident: got %v, want %v", got, want)
+	}
+}
+
+func TestAlertGroupToIncident_RunbookField(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.RunbookField = "u_runbook"
+	defer func() { config.Workflow.RunbookField = "" }()
+
+	tests := []struct {
+		name   string
+		alerts template.Alerts
+		want   string
+	}{
+		{
+			name: "annotation",
+			alerts: template.Alerts{
+				{Annotations: template.KV{"runbook_url": "https://runbooks.example.com/NodeDown"}},
+				{Annotations: template.KV{"runbook_url": "https://runbooks.example.com/other"}},
+			},
+			want: "https://runbooks.example.com/NodeDown",
+		},
+		{name: "missing annotation", alerts: template.Alerts{{Annotations: template.KV{"summary": "Node down"}}}, want: ""},
+		{name: "no alert", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := template.Data{Alerts: tt.alerts}
+			incident, err := alertGroupToIncident(data, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := incident["u_runbook"]; got != tt.want {
+				t.Errorf("Unexpected u_runbook: got %v, want %v", got, tt.want)
+			}
+
+			got, err := applyTemplate("name", "{{ .RunbookURL }}", newTemplateData(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Unexpected .RunbookURL: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlertGroupToIncident_AffectedField(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.AffectedField = "u_affected_cis"
+	defer func() { config.Workflow.AffectedField = "" }()
+
+	data := template.Data{
+		Alerts: template.Alerts{
+			{Labels: template.KV{"instance": "server02:9100"}},
+			{Labels: template.KV{"instance": "server01:9100"}},
+			{Labels: template.KV{"job": "node"}},
+			{Labels: template.KV{"instance": "server02:9100"}},
+		},
+	}
+	incident, err := alertGroupToIncident(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "server01:9100, server02:9100"
+	if got := incident["u_affected_cis"]; got != want {
+		t.Errorf("Unexpected u_affected_cis: got %v, want %v", got, want)
+	}
+
+	config.Workflow.AffectedLabel = "job"
+	defer func() { config.Workflow.AffectedLabel = "" }()
+	got, err := applyTemplate("name", "{{ .AffectedCIs }}", newTemplateData(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "node" {
+		t.Errorf("Unexpected .AffectedCIs with the job label: got %v, want %v", got, "node")
+	}
+}
+
+func TestAffectedCIs_MaxLength(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	var alerts template.Alerts
+	for i := 0; i < 200; i++ {
+		alerts = append(alerts, template.Alert{Labels: template.KV{"instance": fmt.Sprintf("server%03d:9100", i)}})
+	}
+
+	// Each instance takes 14 characters plus 2 for the separator: 61 instances and the count of the others fit
+	got := affectedCIs(alerts)
+	if len(got) > maxAffectedCIsLength || !strings.HasPrefix(got, "server000:9100, server001:9100") || !strings.HasSuffix(got, "server060:9100 (+139 more)") {
+		t.Errorf("Unexpected capped affected CIs (%d characters): got %v", len(got), got)
+	}
+}
+
+func TestOnAlertGroup_ShortKeyField(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.IncidentGroupKeyField = "u_group_key"
+	config.Workflow.ShortKeyField = "u_short_key"
+	defer loadConfig("test/servicenow_test.yml")
+
+	data := template.Data{Status: "firing", GroupLabels: template.KV{"alertname": "short_key_field"}}
+
+	snClientMock := mockServiceNow()
+
+	if err := onAlertGroup(data); err != nil {
+		t.Fatal(err)
+	}
+
+	groupKey := getGroupKey(data)
+	snClientMock.AssertCalled(t, "GetIncidents", map[string]string{"u_group_key": groupKey})
+	incident := snClientMock.incidentsOf("CreateIncident")[0]
+	if len(groupKey) != 32 || incident["u_group_key"] != groupKey {
+		t.Fatalf("Unexpected group key: got %v searched and %v created", groupKey, incident["u_group_key"])
+	}
+	if incident["u_short_key"] != groupKey[:8] {
+		t.Errorf("Unexpected short key: got %v, want %v", incident["u_short_key"], groupKey[:8])
+	}
+}
+
+func TestAlertGroupToIncident_CategoryFromAlertnamePrefix(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	delete(config.DefaultIncident, "category")
+	config.Workflow.CategoryFromAlertnamePrefix = map[string]string{"DB_": "Database", "DB_Backup": "Backup", "Net_": "Network"}
+	defer loadConfig("test/servicenow_test.yml")
+
+	tests := []struct {
+		name string
+		data template.Data
+		want interface{}
+	}{
+		{name: "common alertname", data: template.Data{CommonLabels: template.KV{"alertname": "DB_ReplicationLag"}}, want: "Database"},
+		{name: "longest prefix", data: template.Data{CommonLabels: template.KV{"alertname": "DB_BackupFailed"}}, want: "Backup"},
+		{name: "first alert", data: template.Data{Alerts: template.Alerts{{Labels: template.KV{"alertname": "Net_LinkDown"}}, {Labels: template.KV{"alertname": "DB_Down"}}}}, want: "Network"},
+		{name: "no match", data: template.Data{CommonLabels: template.KV{"alertname": "NodeDown"}}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			incident, err := alertGroupToIncident(tt.data, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if incident["category"] != tt.want {
+				t.Errorf("Unexpected category: got %v, want %v", incident["category"], tt.want)
+			}
+		})
+	}
+
+	config.DefaultIncident["category"] = "Failure"
+	incident, err := alertGroupToIncident(template.Data{CommonLabels: template.KV{"alertname": "DB_Down"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if incident["category"] != "Failure" {
+		t.Errorf("Explicit category should not be overridden: got %v", incident["category"])
+	}
+}
+
+func TestAlertGroupToIncident_GroupFingerprint(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.GroupFingerprintField = "u_group_fingerprint"
+	defer loadConfig("test/servicenow_test.yml")
+
+	data := template.Data{GroupLabels: template.KV{"alertname": "NodeDown", "instance": "server01"}}
+	incident, err := alertGroupToIncident(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := incident["u_group_fingerprint"]
+	// Fingerprint computed by Alertmanager for the group labels {alertname="NodeDown", instance="server01"}
+	want := "0132845652cda80d"
+	if got != want {
+		t.Errorf("Unexpected group fingerprint: got %v, want %v", got, want)
+	}
+	if got == getGroupKey(data) {
+		t.Errorf("Group fingerprint should differ from the group key: got %v", got)
+	}
+	if again := newTemplateData(data).GroupFingerprint; again != got {
+		t.Errorf("Unstable group fingerprint: got %v, then %v", got, again)
+	}
+}
+
+func TestAlertGroupToIncident_AlertNames(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.AlertNamesField = "u_alertnames"
+	defer func() { config.Workflow.AlertNamesField = "" }()
+
+	data := template.Data{
+		Alerts: template.Alerts{
+			{Labels: template.KV{"alertname": "NodeDown"}},
+			{Labels: template.KV{"alertname": "DiskFull"}},
+			{Labels: template.KV{"instance": "server01"}},
+			{Labels: template.KV{"alertname": "NodeDown"}},
+		},
+	}
+	incident, err := alertGroupToIncident(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "DiskFull, NodeDown"
+	if got := incident["u_alertnames"]; got != want {
+		t.Errorf("Unexpected result: got %v, want %v", got, want)
+	}
+
+	got, err := applyTemplate("name", "{{ .AlertNames }}", newTemplateData(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Unexpected result: got %v, want %v", got, want)
+	}
+}
+
+func TestApplyTemplate_Lookup(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.LookupFile = "test/lookup.yml"
+	defer func() { config.Workflow.LookupFile = "" }()
+
+	var err error
+	lookupTables, err = loadLookupTables(config.Workflow.LookupFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		service string
+		want    string
+	}{
+		{service: "prometheus_bot", want: "Monitoring"},
+		{service: "unknown", want: "NOC"},
+	}
+	for _, tt := range tests {
+		data := template.Data{CommonLabels: template.KV{"service": tt.service}}
+		got, err := applyTemplate("name", `{{ lookup "service" .CommonLabels.service "NOC" }}`, newTemplateData(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Unexpected result: got %v, want %v", got, tt.want)
+		}
+	}
+}
+
+func TestApplyIncidentTemplate_OnTemplateError(t *testing.T) {
+	broken := "{{ .Status "
+	tests := []struct {
+		policy  string
+		want    interface{}
+		present bool
+	}{
+		{policy: "", want: "", present: true},
+		{policy: "blank", want: "", present: true},
+		{policy: "keep", want: broken, present: true},
+		{policy: "skip", want: nil, present: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			config.Workflow.OnTemplateError = tt.policy
+			defer func() { config.Workflow.OnTemplateError = "" }()
+
+			before := testutil.ToFloat64(webhookIncidentTemplateError)
+			incident := Incident{"description": broken, "short_description": "{{ .Status }}"}
+			applyIncidentTemplate(incident, newTemplateData(template.Data{Status: "firing"}))
+
+			got, present := incident["description"]
+			if present != tt.present || (present && got != tt.want) {
+				t.Errorf("Unexpected description: got %v (present: %v), want %v (present: %v)", got, present, tt.want, tt.present)
+			}
+			if incident["short_description"] != "firing" {
+				t.Errorf("Unexpected short_description: got %v, want %v", incident["short_description"], "firing")
+			}
+			if testutil.ToFloat64(webhookIncidentTemplateError)-before != 1 {
+				t.Errorf("Template error metric should be incremented")
+			}
+		})
+	}
+}
+
+func TestApplyIncidentTemplate_Range(t *testing.T) {
+	data := template.Data{
+		CommonAnnotations: map[string]string{
+			"error":   "a",
+			"warning": "b",
+		},
+	}
+	incident := Incident{
+		"description": "{{ range $key, $val := .CommonAnnotations}}{{ $key }}:{{ $val }} {{end}}",
+	}
+	applyIncidentTemplate(incident, newTemplateData(data))
+
+	got := incident["description"]
+	want := "error:a warning:b "
+
+	if got != want {
+		t.Errorf("Unexpected result: got %v, want %v", got, want)
+	}
+}
+
+func TestApplyIncidentTemplate_FiringAndResolvedAlerts(t *testing.T) {
+	content, err := ioutil.ReadFile("test/alertmanager_partially_resolved.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := template.Data{}
+	if err := json.Unmarshal(content, &data); err != nil {
+		t.Fatal(err)
+	}
+
+	incident := Incident{
+		"description": "Firing: {{ range .FiringAlerts }}{{ .Labels.instance }} {{ end }}Resolved: {{ range .ResolvedAlerts }}{{ .Labels.instance }} {{ end }}",
+	}
+	applyIncidentTemplate(incident, newTemplateData(data))
+
+	got := incident["description"]
+	want := "Firing: server01.int:9100 server03.int:9100 Resolved: server02.int:9100 "
+	if got != want {
+		t.Errorf("Unexpected result: got %v, want %v", got, want)
+	}
+}
+
+func TestApplyIncidentTemplate_MaxAlertsInDescription(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	config.Workflow.MaxAlertsInDescription = 3
+	defer loadConfig("test/servicenow_test.yml")
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var alerts template.Alerts
+	for i := 99; i >= 0; i-- {
+		alerts = append(alerts, template.Alert{StartsAt: start.Add(time.Duration(i) * time.Minute), Labels: template.KV{"instance": fmt.Sprintf("server%02d", i)}})
+	}
+	data := template.Data{Alerts: alerts}
+
+	incident := Incident{
+		"description": "{{ .AlertCount }} alerts: {{ range .Alerts }}{{ .Labels.instance }} {{ end }}{{ .MoreAlerts }}",
+	}
+	applyIncidentTemplate(incident, newTemplateData(data))
+
+	got := incident["description"]
+	want := "100 alerts: server00 server01 server02 ...and 97 more"
+	if got != want {
+		t.Errorf("Unexpected result: got %v, want %v", got, want)
+	}
+	if len(data.Alerts) != 100 || data.Alerts[0].Labels["instance"] != "server99" {
+		t.Errorf("Alert group was modified by the truncation")
+	}
+}
+
+func TestApplyIncidentTemplate_Reload(t *testing.T) {
+	configFile := `
+service_now:
+ instance_name: "instance"
+ user_name: "SA"
+ password: "SA!"
+workflow:
+ incident_group_key_field: "u_other_reference_1"
+default_incident:
+ description: "%s"
+`
+	data := template.Data{Status: "firing"}
+
+	if _, err := loadConfigContent([]byte(fmt.Sprintf(configFile, "First {{ .Status }}"))); err != nil {
+		t.Fatal(err)
+	}
+	incident, _ := alertGroupToIncident(data, nil)
+	if got, want := incident["description"], "First firing"; got != want {
+		t.Errorf("Unexpected result: got %v, want %v", got, want)
+	}
+
+	if _, err := loadConfigContent([]byte(fmt.Sprintf(configFile, "Second {{ .Status }}"))); err != nil {
+		t.Fatal(err)
+	}
+	incident, _ = alertGroupToIncident(data, nil)
+	if got, want := incident["description"], "Second firing"; got != want {
+		t.Errorf("Unexpected result: got %v, want %v", got, want)
+	}
+}
+
+func benchmarkApplyIncidentTemplate(b *testing.B, compiled bool) {
+	loadConfig("test/servicenow_test.yml")
+	if !compiled {
+		incidentTemplates = nil
+	}
+	content, err := ioutil.ReadFile("test/alertmanager_firing.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := template.Data{}
+	if err := json.Unmarshal(content, &data); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		incident := Incident{}
+		for k, v := range config.DefaultIncident {
+			incident[k] = v
+		}
+		applyIncidentTemplate(incident, newTemplateData(data))
+	}
+}
+
+func BenchmarkApplyIncidentTemplate_Compiled(b *testing.B) {
+	benchmarkApplyIncidentTemplate(b, true)
+}
+
+func BenchmarkApplyIncidentTemplate_Parsed(b *testing.B) {
+	benchmarkApplyIncidentTemplate(b, false)
+}
+
+func TestLoadConfigContent_Ok_Minimal(t *testing.T) {
+	configFile := `
+service_now:
+ instance_name: "instance"
+ user_name: "SA"
+ password: "SA!" 
+workflow:
+ incident_group_key_field: "u_other_reference_1"
+`
+	want := Config{
+		ServiceNow: ServiceNowConfig{
+			InstanceName: "instance",
+			UserName:     "SA",
+			Password:     "SA!",
+		},
+		Workflow: WorkflowConfig{
+			IncidentGroupKeyField: "u_other_reference_1",
+		},
+		DefaultIncident: nil,
+	}
+	got, err := loadConfigContent([]byte(configFile))
+	if err != nil {
+		t.Errorf("Error on loading config content %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Error in getting config Got:%v, Expected config:%v", got, want)
+	}
+}
+
+func TestLoadConfigContent_Ok_Standard(t *testing.T) {
 	configFile := `
 service_now:
  instance_name: "instance"
@@ -399,6 +3514,239 @@ default_incident:
 	}
 }
 
+func TestLoadConfigContent_UnknownMinSeverity(t *testing.T) {
+	configFile := `
+service_now:
+ instance_name: "instance"
+ user_name: "SA"
+ password: "SA!"
+workflow:
+ incident_group_key_field: "u_other_reference_1"
+ min_severity: "major"
+`
+	_, err := loadConfigContent([]byte(configFile))
+	if err == nil {
+		t.Errorf("Should have an error with an unknown min_severity")
+	}
+}
+
+func TestLoadConfig_Directory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer loadConfig("test/servicenow_test.yml")
+
+	fragments := map[string]string{
+		"01-instance.yml": `
+service_now:
+ instance_name: "instance"
+ user_name: "SA"
+ password: "SA!"
+workflow:
+ incident_group_key_field: "u_other_reference_1"
+default_incident:
+ category: "Failure"
+ impact: "2"
+`,
+		"02-workflow.yml": `
+workflow:
+ incident_group_key_field: "short_description"
+ no_update_states: [6]
+default_incident:
+ impact: "3"
+`,
+		"ignored.yaml": `
+service_now:
+ instance_name: "ignored"
+`,
+	}
+	for name, content := range fragments {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config, err := loadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ServiceNow.InstanceName != "instance" || config.ServiceNow.UserName != "SA" {
+		t.Errorf("Unexpected service_now config: got %+v", config.ServiceNow)
+	}
+	if config.Workflow.IncidentGroupKeyField != "short_description" || len(config.Workflow.NoUpdateStates) != 1 {
+		t.Errorf("Unexpected workflow config: got %+v", config.Workflow)
+	}
+	want := map[string]string{"category": "Failure", "impact": "3"}
+	if !reflect.DeepEqual(config.DefaultIncident, want) {
+		t.Errorf("Unexpected default_incident: got %v, want %v", config.DefaultIncident, want)
+	}
+}
+
+func TestLoadConfig_MissingFileWithEnvVars(t *testing.T) {
+	defer loadConfig("test/servicenow_test.yml")
+	missingFile := "test/missing_servicenow.yml"
+
+	if _, err := loadConfig(missingFile); err == nil {
+		t.Errorf("Expected an error without config file nor env vars, got none")
+	}
+
+	env := map[string]string{
+		"SERVICENOW_INSTANCE_NAME":            "instance",
+		"SERVICENOW_USERNAME":                 "SA",
+		"SERVICENOW_PASSWORD":                 "SA!",
+		"SERVICENOW_INCIDENT_GROUP_KEY_FIELD": "u_other_reference_1",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	config, err := loadConfig(missingFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ServiceNow.InstanceName != "instance" || config.Workflow.IncidentGroupKeyField != "u_other_reference_1" {
+		t.Errorf("Unexpected config: got %+v", config)
+	}
+	if _, err := loadSnClient(); err != nil {
+		t.Errorf("Unexpected error loading the ServiceNow client: %v", err)
+	}
+
+	// A config file given on the command line must exist
+	configFileExplicit = true
+	defer func() { configFileExplicit = false }()
+	if _, err := loadConfig(missingFile); err == nil {
+		t.Errorf("Expected an error with a missing explicit config file, got none")
+	}
+}
+
+func TestLintIncidentTemplates(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+	templates := compileIncidentTemplates(map[string]string{
+		"short_description": "{{ .CommonLabels.alertname }} on {{ .CommonLabels.instance }}",
+		"description":       "{{ .CommonAnnotations.sumary }}",
+		"comments":          "{{ .CommonLabls.severity }}",
+		"category":          "Software",
+	})
+
+	warnings := lintIncidentTemplates(templates)
+	if len(warnings) != 2 {
+		t.Fatalf("Unexpected warnings: got %q, want 2 warnings", warnings)
+	}
+	if !strings.Contains(warnings[0], "comments template fails") || !strings.Contains(warnings[0], "CommonLabls") {
+		t.Errorf("Unexpected warning for the typo'd field: %q", warnings[0])
+	}
+	if !strings.Contains(warnings[1], "description template renders <no value>") {
+		t.Errorf("Unexpected warning for the typo'd annotation: %q", warnings[1])
+	}
+}
+
+func TestLoadConfigContent_BothStateLists(t *testing.T) {
+	configFile := `
+service_now:
+ instance_name: "instance"
+ user_name: "SA"
+ password: "SA!"
+workflow:
+ incident_group_key_field: "u_other_reference_1"
+ no_update_states: [6,7,8]
+ updatable_states: [1,2,3]
+`
+	_, err := loadConfigContent([]byte(configFile))
+	if err == nil {
+		t.Errorf("Should have an error with both no_update_states and updatable_states")
+	}
+}
+
+func TestFilterUpdatableIncidents_NormalizedStates(t *testing.T) {
+	loadConfig("test/servicenow_test.yml")
+
+	incidents := []Incident{
+		{"number": "INC1", "state": "1"},
+		{"number": "INC6", "state": "6"},
+		{"number": "INC7", "state": float64(7)},
+		{"number": "INC8", "state": " 8"},
+	}
+	var got []string
+	for _, incident := range filterUpdatableIncidents(incidents) {
+		got = append(got, incident.GetNumber())
+	}
+	want := []string{"INC1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected updatable incidents: got %v, want %v", got, want)
+	}
+}
+
+func TestFilterUpdatableIncidents_UpdatableStates(t *testing.T) {
+	configFile := `
+service_now:
+ instance_name: "instance"
+ user_name: "SA"
+ password: "SA!"
+workflow:
+ incident_group_key_field: "u_other_reference_1"
+ updatable_states: [1,2]
+`
+	if _, err := loadConfigContent([]byte(configFile)); err != nil {
+		t.Fatal(err)
+	}
+	defer loadConfig("test/servicenow_test.yml")
+
+	incidents := []Incident{
+		{"number": "INC1", "state": "1"},
+		{"number": "INC2", "state": "2"},
+		{"number": "INC6", "state": "6"},
+		{"number": "INC42", "state": "42"},
+	}
+	var got []string
+	for _, incident := range filterUpdatableIncidents(incidents) {
+		got = append(got, incident.GetNumber())
+	}
+	want := []string{"INC1", "INC2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected updatable incidents: got %v, want %v", got, want)
+	}
+}
+
+func TestConfigWarnings_DisplayValueNumericStates(t *testing.T) {
+	c := Config{
+		ServiceNow: ServiceNowConfig{DisplayValue: "true"},
+		Workflow:   WorkflowConfig{NoUpdateStates: []json.Number{"6", "7"}},
+	}
+	if warnings := c.warnings(); len(warnings) != 1 {
+		t.Errorf("Expected one warning, got: %v", warnings)
+	}
+
+	c.Workflow.NoUpdateStates = []json.Number{"Resolved", "Closed"}
+	if warnings := c.warnings(); len(warnings) != 0 {
+		t.Errorf("Expected no warning, got: %v", warnings)
+	}
+
+	c.ServiceNow.DisplayValue = ""
+	c.Workflow.NoUpdateStates = []json.Number{"6", "7"}
+	if warnings := c.warnings(); len(warnings) != 0 {
+		t.Errorf("Expected no warning, got: %v", warnings)
+	}
+}
+
+func TestLoadConfigContent_MissingLookupFile(t *testing.T) {
+	configFile := `
+service_now:
+ instance_name: "instance"
+ user_name: "SA"
+ password: "SA!"
+workflow:
+ incident_group_key_field: "u_other_reference_1"
+ lookup_file: "test/missing.yml"
+`
+	_, err := loadConfigContent([]byte(configFile))
+	if err == nil {
+		t.Errorf("Should have an error with a missing lookup file")
+	}
+}
+
 func TestLoadConfigContent_ParsingError(t *testing.T) {
 	configFile := `
 service_now:
@@ -427,6 +3775,36 @@ service_now:
 	}
 }
 
+func Test_computePriority(t *testing.T) {
+	tests := []struct {
+		name     string
+		incident Incident
+		want     interface{}
+	}{
+		{name: "high_high", incident: Incident{"impact": "1", "urgency": "1"}, want: "1"},
+		{name: "high_medium", incident: Incident{"impact": "1", "urgency": "2"}, want: "2"},
+		{name: "high_low", incident: Incident{"impact": "1", "urgency": "3"}, want: "3"},
+		{name: "medium_high", incident: Incident{"impact": "2", "urgency": "1"}, want: "2"},
+		{name: "medium_medium", incident: Incident{"impact": "2", "urgency": "2"}, want: "3"},
+		{name: "medium_low", incident: Incident{"impact": "2", "urgency": "3"}, want: "4"},
+		{name: "low_high", incident: Incident{"impact": "3", "urgency": "1"}, want: "3"},
+		{name: "low_medium", incident: Incident{"impact": "3", "urgency": "2"}, want: "4"},
+		{name: "low_low", incident: Incident{"impact": "3", "urgency": "3"}, want: "5"},
+		{name: "provided", incident: Incident{"impact": "1", "urgency": "1", "priority": "4"}, want: "4"},
+		{name: "missing_urgency", incident: Incident{"impact": "1"}, want: nil},
+		{name: "not_numeric", incident: Incident{"impact": "high", "urgency": "1"}, want: nil},
+		{name: "out_of_range", incident: Incident{"impact": "4", "urgency": "1"}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			computePriority(tt.incident)
+			if got := tt.incident["priority"]; got != tt.want {
+				t.Errorf("computePriority() priority = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_validateIncident(t *testing.T) {
 	type args struct {
 		incident Incident
@@ -470,3 +3848,35 @@ func Test_validateIncident(t *testing.T) {
 		})
 	}
 }
+
+func Test_validateIncident_ValidationErrors(t *testing.T) {
+	err := validateIncident(Incident{"impact": "high", "urgency": "low", "category": "Software"})
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("validateIncident() error = %T, want ValidationErrors", err)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("Unexpected number of validation errors: got %d, want 2: %v", len(errs), errs)
+	}
+	if errs[0].Field != "impact" || errs[0].Value != "high" {
+		t.Errorf("Unexpected first validation error: got %+v", errs[0])
+	}
+	if errs[1].Field != "urgency" || errs[1].Value != "low" {
+		t.Errorf("Unexpected second validation error: got %+v", errs[1])
+	}
+	if !strings.Contains(err.Error(), "'impact' field value is high") || !strings.Contains(err.Error(), "'urgency' field value is low") {
+		t.Errorf("Unexpected error message: %v", err)
+	}
+}
+
+func Test_validateIncident_AllowedCategories(t *testing.T) {
+	config.Workflow.AllowedCategories = []string{"Software", "Hardware"}
+	defer func() { config.Workflow.AllowedCategories = nil }()
+
+	if err := validateIncident(Incident{"category": "Software"}); err != nil {
+		t.Errorf("validateIncident() unexpected error = %v", err)
+	}
+	if err := validateIncident(Incident{"category": "Sofware"}); err == nil {
+		t.Errorf("validateIncident() expected an error for a disallowed category")
+	}
+}
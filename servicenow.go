@@ -2,40 +2,90 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/common/log"
 )
 
 const (
-	serviceNowBaseURL   = "https://%s.service-now.com"
+	serviceNowBaseURL   = "https://%s.%s"
+	defaultDomain       = "service-now.com"
 	tableAPI            = "%s/api/now/v2/table/%s"
 	hibernatingInstance = "Hibernating Instance"
+	defaultResultPath   = "result"
+
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 10
+	defaultIdleConnTimeout     = 90 * time.Second
+
+	defaultRetryBackoff = 1 * time.Second
+	maxRetryBackoff     = 30 * time.Second
+)
+
+var (
+	errUnauthorized     = errors.New("ServiceNow returned the HTTP error code: 401")
+	errConflict         = errors.New("ServiceNow returned the HTTP error code: 409")
+	errIncidentNotFound = errors.New("Incident not found")
 )
 
+// unavailableError is a failure telling that ServiceNow is unavailable: a transport error, a server error or a non-API page (maintenance, hibernation)
+type unavailableError struct {
+	error
+}
+
+// isUnavailable reports whether a request failed as ServiceNow is unavailable or rejects the credentials,
+// unlike a rejected request which would fail again the same way
+func isUnavailable(err error) bool {
+	_, ok := err.(unavailableError)
+	return ok || err == errUnauthorized
+}
+
 // Incident is a model of the ServiceNow incident table
 type Incident map[string]interface{}
 
 // GetSysID returns the sys_id of the incident
 func (i Incident) GetSysID() string {
-	return i["sys_id"].(string)
+	sysID, _ := i["sys_id"].(string)
+	return sysID
 }
 
 // GetNumber returns the number of the incident
 func (i Incident) GetNumber() string {
-	return i["number"].(string)
+	number, _ := i["number"].(string)
+	return number
+}
+
+// IsNumberMissing returns whether the incident was created without number in the ServiceNow response
+func (i Incident) IsNumberMissing() bool {
+	missing, _ := i["number_missing"].(bool)
+	return missing
 }
 
 // GetState returns the state of the incident
 func (i Incident) GetState() json.Number {
-	return json.Number(i["state"].(string))
+	switch state := i["state"].(type) {
+	case string:
+		return json.Number(state)
+	case json.Number:
+		return state
+	case float64:
+		return json.Number(strconv.FormatFloat(state, 'f', -1, 64))
+	}
+	return ""
 }
 
 // IncidentResponse is a model of an API response contaning one incident
@@ -43,35 +93,116 @@ type IncidentResponse map[string]interface{}
 
 // GetResult returns the incident from the IncidentResponse
 func (ir IncidentResponse) GetResult() Incident {
-	var incident Incident = ir["result"].(map[string]interface{})
-	return incident
+	result, _ := ir.GetResultAt(defaultResultPath)
+	if result == nil {
+		return Incident{}
+	}
+	return result
+}
+
+// GetResultAt returns the incident found at the dotted path (e.g. result.record) of the IncidentResponse
+func (ir IncidentResponse) GetResultAt(path string) (Incident, error) {
+	value, ok := valueAt(ir, path)
+	if !ok {
+		return nil, fmt.Errorf("ServiceNow response has no %s field", path)
+	}
+	result, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("ServiceNow response %s field is not an object", path)
+	}
+	return Incident(result), nil
 }
 
 // IncidentsResponse is a model of an API response contaning multiple incidents
 type IncidentsResponse map[string]interface{}
 
-// GetResults returns the incidents from the IncidentsResponse
+// GetResults returns the incidents from the IncidentsResponse.
+// Results that are not JSON objects are skipped.
 func (ir IncidentsResponse) GetResults() []Incident {
-	results := ir["result"].([]interface{})
-	incidents := make([]Incident, len(results))
-	for i, result := range results {
-		incidents[i] = result.(map[string]interface{})
+	incidents, err := ir.GetResultsAt(defaultResultPath)
+	if err != nil {
+		return []Incident{}
 	}
 	return incidents
 }
 
+// GetResultsAt returns the incidents found at the dotted path (e.g. result.records) of the IncidentsResponse.
+// Results that are not JSON objects are skipped.
+func (ir IncidentsResponse) GetResultsAt(path string) ([]Incident, error) {
+	value, ok := valueAt(ir, path)
+	if !ok {
+		return nil, fmt.Errorf("ServiceNow response has no %s field", path)
+	}
+	results, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("ServiceNow response %s field is not an array", path)
+	}
+	incidents := make([]Incident, 0, len(results))
+	for _, result := range results {
+		incident, ok := result.(map[string]interface{})
+		if !ok {
+			serviceNowMalformedIncident.Inc()
+			log.Warnf("Skipping malformed incident in ServiceNow response: %v", result)
+			continue
+		}
+		incidents = append(incidents, incident)
+	}
+	return incidents, nil
+}
+
+// valueAt returns the value found at a dotted path of a JSON object, and whether it exists
+func valueAt(object map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = object
+	for _, key := range strings.Split(path, ".") {
+		parent, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = parent[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
 // ServiceNow interface
 type ServiceNow interface {
 	CreateIncident(incidentParam Incident) (Incident, error)
+	CreateIncidentInTable(incidentParam Incident, table string) (Incident, error)
 	GetIncidents(params map[string]string) ([]Incident, error)
+	GetIncidentsInTable(params map[string]string, table string) ([]Incident, error)
+	GetIncidentByNumber(number string) (Incident, error)
 	UpdateIncident(incidentParam Incident, sysID string) (Incident, error)
+	UpdateIncidentInTable(incidentParam Incident, sysID string, table string) (Incident, error)
+	GetLatestJournalEntry(sysID string, element string) (string, error)
+	GetUserSysID(user string) (string, error)
+	CheckHealth() error
 }
 
 // ServiceNowClient is the interface to a ServiceNow instance
 type ServiceNowClient struct {
-	baseURL    string
-	authHeader string
-	client     *http.Client
+	baseURL            string
+	authHeader         string
+	authMutex          sync.RWMutex
+	userName           string
+	passwordFile       string
+	client             *http.Client
+	noCount            bool
+	displayValue       string
+	checkErrorEnvelope bool
+	matchTable         string
+	queryNoDomain      bool
+	maxResponseBytes   int64
+	methodOverride     string
+	resultPath         string
+	maxRetries         int
+	retryBackoff       time.Duration
+	retryJitter        bool
+	random             func(n int64) int64
+	sleep              func(d time.Duration)
+	failFastThreshold  int32
+	failures           int32
+	exit               func(code int)
 }
 
 // NewServiceNowClient will create a new ServiceNow client
@@ -80,6 +211,15 @@ func NewServiceNowClient(instanceName string, userName string, password string)
 		return nil, errors.New("Missing instanceName")
 	}
 
+	return NewServiceNowClientWithBaseURL(instanceURL(instanceName, defaultDomain), userName, password)
+}
+
+// NewServiceNowClientWithBaseURL will create a new ServiceNow client for an instance reachable at the given base URL (e.g.: https://instance.servicenowservices.com)
+func NewServiceNowClientWithBaseURL(baseURL string, userName string, password string) (*ServiceNowClient, error) {
+	if baseURL == "" {
+		return nil, errors.New("Missing baseURL")
+	}
+
 	if userName == "" {
 		return nil, errors.New("Missing userName")
 	}
@@ -89,12 +229,69 @@ func NewServiceNowClient(instanceName string, userName string, password string)
 	}
 
 	return &ServiceNowClient{
-		baseURL:    fmt.Sprintf(serviceNowBaseURL, instanceName),
-		authHeader: fmt.Sprintf("Basic %s", base64.URLEncoding.EncodeToString([]byte(userName+":"+password))),
-		client:     http.DefaultClient,
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		authHeader:   basicAuthHeader(userName, password),
+		userName:     userName,
+		client:       http.DefaultClient,
+		noCount:      true,
+		retryBackoff: defaultRetryBackoff,
+		retryJitter:  true,
+		random:       rand.Int63n,
+		sleep:        time.Sleep,
+		exit:         os.Exit,
 	}, nil
 }
 
+func basicAuthHeader(userName string, password string) string {
+	return fmt.Sprintf("Basic %s", base64.URLEncoding.EncodeToString([]byte(userName+":"+password)))
+}
+
+// instanceURL returns the base URL of a ServiceNow instance hosted on the given domain, or on service-now.com when empty
+func instanceURL(instanceName string, domain string) string {
+	if domain == "" {
+		domain = defaultDomain
+	}
+	return fmt.Sprintf(serviceNowBaseURL, instanceName, domain)
+}
+
+// newTransport creates the HTTP transport used to reach ServiceNow, with the given idle connections settings.
+// Zero values are replaced by defaults.
+func newTransport(maxIdleConns int, maxIdleConnsPerHost int, idleConnTimeout time.Duration) *http.Transport {
+	if maxIdleConns <= 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+	if maxIdleConnsPerHost <= 0 {
+		maxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if idleConnTimeout <= 0 {
+		idleConnTimeout = defaultIdleConnTimeout
+	}
+
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// disableHTTP2 forces the transport to use HTTP/1.1, as a non-nil empty TLSNextProto map disables the HTTP/2 negotiation
+func disableHTTP2(transport *http.Transport) {
+	transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+}
+
+// setClientCertificate loads the X.509 key pair presented by the transport to a ServiceNow gateway requiring mutual TLS
+func setClientCertificate(transport *http.Transport, certFile string, keyFile string) error {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading the client certificate: %v", err)
+	}
+	transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	return nil
+}
+
 // Create a table item in ServiceNow from a post body
 func (snClient *ServiceNowClient) create(table string, body []byte) ([]byte, error) {
 	url := fmt.Sprintf(tableAPI, snClient.baseURL, table)
@@ -120,64 +317,271 @@ func (snClient *ServiceNowClient) get(table string, params map[string]string) ([
 	for key, val := range params {
 		q.Add(key, val)
 	}
+	if snClient.queryNoDomain {
+		// Search across all domains of a domain-separated instance, not only the one of the integration user
+		q.Set("sysparm_query_no_domain", "true")
+	}
 	req.URL.RawQuery = q.Encode()
 
 	return snClient.doRequest(req)
 }
 
-// update a table item in ServiceNow from a post body and a sys_id
+// update a table item in ServiceNow from a post body and a sys_id.
+// With a method override, the update is sent as a POST with the X-HTTP-Method-Override header, for proxies blocking PUT and PATCH.
 func (snClient *ServiceNowClient) update(table string, body []byte, sysID string) ([]byte, error) {
 	url := fmt.Sprintf(tableAPI+"/%s", snClient.baseURL, table, sysID)
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(body))
+	method := "PUT"
+	if len(snClient.methodOverride) > 0 {
+		method = "POST"
+	}
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
 	if err != nil {
 		log.Errorf("Error creating the request. %s", err)
 		return nil, err
 	}
+	if len(snClient.methodOverride) > 0 {
+		req.Header.Set("X-HTTP-Method-Override", snClient.methodOverride)
+	}
 
 	return snClient.doRequest(req)
 }
 
-// doRequest will do the given ServiceNow request and return response as byte array
+// withParam returns a copy of the params with an additional param
+func withParam(params map[string]string, key string, value string) map[string]string {
+	newParams := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		newParams[k] = v
+	}
+	newParams[key] = value
+	return newParams
+}
+
+// doRequest will do the given ServiceNow request and return response as byte array.
+// Transport errors, throttling and server errors are retried up to maxRetries times, with an exponential backoff.
+// Record creations are only retried when throttled, as ServiceNow may have created the record before failing.
+// An authentication failure is retried once when the password could be reloaded from the password file.
 func (snClient *ServiceNowClient) doRequest(req *http.Request) ([]byte, error) {
+	responseBody, err := snClient.doRequestWithRetries(req)
+	snClient.countFailure(err)
+	return responseBody, err
+}
+
+// countFailure keeps track of the consecutive failed requests, and exits the process once the fail fast threshold is reached.
+// Only unavailability failures are counted, a request rejected by ServiceNow does not tell that it is down.
+func (snClient *ServiceNowClient) countFailure(err error) {
+	if snClient.failFastThreshold <= 0 {
+		return
+	}
+	if err == nil {
+		atomic.StoreInt32(&snClient.failures, 0)
+		return
+	}
+	if !isUnavailable(err) {
+		return
+	}
+	if failures := atomic.AddInt32(&snClient.failures, 1); failures == snClient.failFastThreshold {
+		log.Errorf("Exiting after %d consecutive failed ServiceNow requests, last error: %v", failures, err)
+		snClient.exit(1)
+	}
+}
+
+func (snClient *ServiceNowClient) doRequestWithRetries(req *http.Request) ([]byte, error) {
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", snClient.authHeader)
+
+	reloaded := false
+	for attempt := 0; ; attempt++ {
+		req.Header.Set("Authorization", snClient.getAuthHeader())
+		responseBody, retryable, err := snClient.doAttempt(req)
+		if err == errUnauthorized && !reloaded && snClient.reloadPassword() {
+			log.Warn("Retrying ServiceNow request with the reloaded password")
+			reloaded = true
+			attempt--
+		} else if err == nil || !retryable || attempt >= snClient.maxRetries {
+			return responseBody, err
+		} else {
+			backoff := snClient.backoff(attempt)
+			log.Warnf("Retrying ServiceNow request in %v (retry %d/%d)", backoff, attempt+1, snClient.maxRetries)
+			snClient.sleep(backoff)
+		}
+
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (snClient *ServiceNowClient) getAuthHeader() string {
+	snClient.authMutex.RLock()
+	defer snClient.authMutex.RUnlock()
+	return snClient.authHeader
+}
+
+// reloadPassword reads the password file again, and reports whether the password changed
+func (snClient *ServiceNowClient) reloadPassword() bool {
+	if len(snClient.passwordFile) == 0 {
+		return false
+	}
+	password, err := readPasswordFile(snClient.passwordFile)
+	if err != nil {
+		log.Errorf("Error reloading the ServiceNow password: %v", err)
+		return false
+	}
+
+	snClient.authMutex.Lock()
+	defer snClient.authMutex.Unlock()
+	authHeader := basicAuthHeader(snClient.userName, password)
+	if authHeader == snClient.authHeader {
+		return false
+	}
+	snClient.authHeader = authHeader
+	log.Infof("ServiceNow password reloaded from %s", snClient.passwordFile)
+	return true
+}
+
+// readPasswordFile returns the password held by a file, without surrounding whitespaces
+func readPasswordFile(passwordFile string) (string, error) {
+	content, err := ioutil.ReadFile(passwordFile)
+	if err != nil {
+		return "", err
+	}
+	password := strings.TrimSpace(string(content))
+	if len(password) == 0 {
+		return "", fmt.Errorf("Password file %s is empty", passwordFile)
+	}
+	return password, nil
+}
+
+// backoff returns the delay before the given retry attempt: an exponential backoff,
+// with full jitter (a random delay between 0 and the backoff) unless disabled
+func (snClient *ServiceNowClient) backoff(attempt int) time.Duration {
+	backoff := snClient.retryBackoff
+	for i := 0; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	if !snClient.retryJitter {
+		return backoff
+	}
+	return time.Duration(snClient.random(int64(backoff) + 1))
+}
+
+// isIdempotent reports whether a request may be sent again without side effect, which is the case of every request but record creations
+func isIdempotent(req *http.Request) bool {
+	return req.Method != http.MethodPost || len(req.Header.Get("X-HTTP-Method-Override")) > 0
+}
+
+// doAttempt sends the request once, and reports whether a failure may be retried
+func (snClient *ServiceNowClient) doAttempt(req *http.Request) ([]byte, bool, error) {
 	resp, err := snClient.client.Do(req)
 
 	if err != nil {
 		log.Errorf("Error sending the request. %s", err)
-		return nil, err
+		return nil, isIdempotent(req), unavailableError{err}
 	}
+	defer resp.Body.Close()
 
 	serviceNowRequests.WithLabelValues(req.URL.Host, req.Method, strconv.Itoa(resp.StatusCode)).Inc()
 	serviceNowLastRequest.SetToCurrentTime()
 
-	if resp.StatusCode >= 400 {
-		errorMsg := fmt.Sprintf("ServiceNow returned the HTTP error code: %v", resp.StatusCode)
-		log.Error(errorMsg)
-		return nil, errors.New(errorMsg)
+	if resp.StatusCode == http.StatusUnauthorized {
+		serviceNowAuthFailures.Inc()
+		log.Errorf("ServiceNow authentication failed, the service account credentials may have been changed: %v", errUnauthorized)
+		return nil, false, errUnauthorized
 	}
 
-	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		log.Error(errConflict)
+		return nil, false, errConflict
+	}
 
-	responseBody, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		err := fmt.Errorf("ServiceNow returned the HTTP error code: %v", resp.StatusCode)
+		log.Error(err)
+		if resp.StatusCode >= 500 {
+			return nil, isIdempotent(req), unavailableError{err}
+		}
+		return nil, resp.StatusCode == http.StatusTooManyRequests, err
+	}
+
+	body := io.Reader(resp.Body)
+	if snClient.maxResponseBytes > 0 {
+		// Read one more byte than allowed, to tell a body of exactly the maximum size from a larger one
+		body = io.LimitReader(resp.Body, snClient.maxResponseBytes+1)
+	}
+	responseBody, err := ioutil.ReadAll(body)
 	if err != nil {
 		log.Errorf("Error reading the body. %s", err)
-		return nil, err
+		return nil, isIdempotent(req), unavailableError{err}
+	}
+	if snClient.maxResponseBytes > 0 && int64(len(responseBody)) > snClient.maxResponseBytes {
+		err := fmt.Errorf("ServiceNow response body exceeds the maximum size of %d bytes", snClient.maxResponseBytes)
+		log.Error(err)
+		return nil, false, err
 	}
 
 	if !json.Valid(responseBody) {
 		if strings.Contains(string(responseBody), hibernatingInstance) {
-			return nil, errors.New("ServiceNow is in sleeping mode and is unavailable (Hibernating Instance)")
+			return nil, false, unavailableError{errors.New("ServiceNow is in sleeping mode and is unavailable (Hibernating Instance)")}
 		}
-		return nil, errors.New("ServiceNow is unavailable (API return format is not valid JSON)")
+		// A maintenance page is answered instead of the API response
+		return nil, false, unavailableError{errors.New("ServiceNow is unavailable (API return format is not valid JSON)")}
 	}
 
-	return responseBody, nil
+	if snClient.checkErrorEnvelope {
+		if err := envelopeError(responseBody); err != nil {
+			log.Error(err)
+			return nil, false, err
+		}
+	}
+
+	return responseBody, false, nil
+}
+
+// errorEnvelope is the error format of ServiceNow API responses
+type errorEnvelope struct {
+	Message string `json:"message"`
+	Detail  string `json:"detail"`
+}
+
+// envelopeError returns an error if the response body holds a ServiceNow error envelope,
+// either at the root of the response or in its result
+func envelopeError(body []byte) error {
+	var response struct {
+		Error  *errorEnvelope  `json:"error"`
+		Result json.RawMessage `json:"result"`
+	}
+	// Responses not matching the error format are not errors
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil
+	}
+
+	envelope := response.Error
+	if envelope == nil && len(response.Result) > 0 {
+		var result struct {
+			Error *errorEnvelope `json:"error"`
+		}
+		if err := json.Unmarshal(response.Result, &result); err == nil {
+			envelope = result.Error
+		}
+	}
+	if envelope == nil || (len(envelope.Message) == 0 && len(envelope.Detail) == 0) {
+		return nil
+	}
+	return fmt.Errorf("ServiceNow returned an error: %s %s", envelope.Message, envelope.Detail)
 }
 
 // CreateIncident will create an incident in ServiceNow from a given Incident, and return the created incident
 func (snClient *ServiceNowClient) CreateIncident(incidentParam Incident) (Incident, error) {
-	log.Info("Create a ServiceNow incident")
+	return snClient.CreateIncidentInTable(incidentParam, "incident")
+}
+
+// CreateIncidentInTable will create an incident in the given ServiceNow table from a given Incident, and return the created incident
+func (snClient *ServiceNowClient) CreateIncidentInTable(incidentParam Incident, table string) (Incident, error) {
+	log.Infof("Create a ServiceNow incident in table %s", table)
 
 	postBody, err := json.Marshal(incidentParam)
 	if err != nil {
@@ -185,7 +589,7 @@ func (snClient *ServiceNowClient) CreateIncident(incidentParam Incident) (Incide
 		return nil, err
 	}
 
-	response, err := snClient.create("incident", postBody)
+	response, err := snClient.create(table, postBody)
 	if err != nil {
 		log.Errorf("Error while creating the incident. %s", err)
 		return nil, err
@@ -198,16 +602,50 @@ func (snClient *ServiceNowClient) CreateIncident(incidentParam Incident) (Incide
 		return nil, err
 	}
 
-	createdIncident := incidentResponse.GetResult()
-	log.Infof("Incident %s created", createdIncident.GetNumber())
+	createdIncident, err := snClient.incidentResult(incidentResponse)
+	if err != nil {
+		log.Errorf("Error while reading the created incident. %s", err)
+		return nil, err
+	}
+	if len(createdIncident.GetNumber()) == 0 {
+		// The number may be hidden by ACLs
+		createdIncident["number_missing"] = true
+		log.Warnf("Incident with sys_id %s created, without number in the ServiceNow response", createdIncident.GetSysID())
+	} else {
+		log.Infof("Incident %s created", createdIncident.GetNumber())
+	}
 
 	return createdIncident, nil
 }
 
-// GetIncidents will retrieve an incident from ServiceNow
+// incidentResult returns the incident of a response, at the configured result path which must exist in the response
+func (snClient *ServiceNowClient) incidentResult(response IncidentResponse) (Incident, error) {
+	if len(snClient.resultPath) == 0 {
+		return response.GetResult(), nil
+	}
+	return response.GetResultAt(snClient.resultPath)
+}
+
+// GetIncidents will retrieve an incident from ServiceNow, from the match table when configured
 func (snClient *ServiceNowClient) GetIncidents(params map[string]string) ([]Incident, error) {
-	log.Infof("Get ServiceNow incidents with params: %v", params)
-	response, err := snClient.get("incident", params)
+	table := "incident"
+	if len(snClient.matchTable) > 0 {
+		table = snClient.matchTable
+	}
+	return snClient.GetIncidentsInTable(params, table)
+}
+
+// GetIncidentsInTable will retrieve incidents from the given ServiceNow table
+func (snClient *ServiceNowClient) GetIncidentsInTable(params map[string]string, table string) ([]Incident, error) {
+	log.Infof("Get ServiceNow incidents of table %s with params: %v", table, params)
+	if snClient.noCount {
+		// Avoid the computation of the total count header, which is not used
+		params = withParam(params, "sysparm_no_count", "true")
+	}
+	if len(snClient.displayValue) > 0 {
+		params = withParam(params, "sysparm_display_value", snClient.displayValue)
+	}
+	response, err := snClient.get(table, params)
 
 	if err != nil {
 		log.Errorf("Error while getting the incident. %s", err)
@@ -221,12 +659,38 @@ func (snClient *ServiceNowClient) GetIncidents(params map[string]string) ([]Inci
 		return nil, err
 	}
 
-	return incidentsResponse.GetResults(), nil
+	if len(snClient.resultPath) == 0 {
+		return incidentsResponse.GetResults(), nil
+	}
+	incidents, err := incidentsResponse.GetResultsAt(snClient.resultPath)
+	if err != nil {
+		log.Errorf("Error while reading the incidents. %s", err)
+		return nil, err
+	}
+	return incidents, nil
+}
+
+// GetIncidentByNumber will retrieve the incident with the given number from ServiceNow, or return errIncidentNotFound
+func (snClient *ServiceNowClient) GetIncidentByNumber(number string) (Incident, error) {
+	incidents, err := snClient.GetIncidents(map[string]string{"number": number, "sysparm_limit": "1"})
+	if err != nil {
+		return nil, err
+	}
+	if len(incidents) == 0 {
+		log.Infof("Incident %s not found", number)
+		return nil, errIncidentNotFound
+	}
+	return incidents[0], nil
 }
 
 // UpdateIncident will update an incident in ServiceNow from a given Incident, and return the updated incident
 func (snClient *ServiceNowClient) UpdateIncident(incidentParam Incident, sysID string) (Incident, error) {
-	log.Infof("Update %v field(s) of ServiceNow incident with id : %s", len(incidentParam), sysID)
+	return snClient.UpdateIncidentInTable(incidentParam, sysID, "incident")
+}
+
+// UpdateIncidentInTable will update an incident of the given ServiceNow table from a given Incident, and return the updated incident
+func (snClient *ServiceNowClient) UpdateIncidentInTable(incidentParam Incident, sysID string, table string) (Incident, error) {
+	log.Infof("Update %v field(s) of ServiceNow incident of table %s with id : %s", len(incidentParam), table, sysID)
 
 	postBody, err := json.Marshal(incidentParam)
 	if err != nil {
@@ -234,7 +698,7 @@ func (snClient *ServiceNowClient) UpdateIncident(incidentParam Incident, sysID s
 		return nil, err
 	}
 
-	response, err := snClient.update("incident", postBody, sysID)
+	response, err := snClient.update(table, postBody, sysID)
 	if err != nil {
 		log.Errorf("Error while updating the incident. %s", err)
 		return nil, err
@@ -247,8 +711,87 @@ func (snClient *ServiceNowClient) UpdateIncident(incidentParam Incident, sysID s
 		return nil, err
 	}
 
-	updatedIncident := incidentResponse.GetResult()
+	updatedIncident, err := snClient.incidentResult(incidentResponse)
+	if err != nil {
+		log.Errorf("Error while reading the updated incident. %s", err)
+		return nil, err
+	}
 	log.Infof("Incident %s updated", updatedIncident.GetNumber())
 
 	return updatedIncident, nil
 }
+
+// GetLatestJournalEntry will retrieve the value of the latest journal entry (e.g. work_notes) of a record from ServiceNow
+func (snClient *ServiceNowClient) GetLatestJournalEntry(sysID string, element string) (string, error) {
+	log.Infof("Get latest ServiceNow %s journal entry of record with id : %s", element, sysID)
+	params := map[string]string{
+		"sysparm_query":  fmt.Sprintf("element_id=%s^element=%s^ORDERBYDESCsys_created_on", sysID, element),
+		"sysparm_limit":  "1",
+		"sysparm_fields": "value",
+	}
+	response, err := snClient.get("sys_journal_field", params)
+	if err != nil {
+		log.Errorf("Error while getting the journal entry. %s", err)
+		return "", err
+	}
+
+	// Journal entries share the same response format as incidents
+	entriesResponse := IncidentsResponse{}
+	err = json.Unmarshal(response, &entriesResponse)
+	if err != nil {
+		log.Errorf("Error while unmarshalling the journal entry. %s", err)
+		return "", err
+	}
+
+	entries := entriesResponse.GetResults()
+	if len(entries) == 0 {
+		return "", nil
+	}
+	value, _ := entries[0]["value"].(string)
+	return value, nil
+}
+
+// GetUserSysID will retrieve the sys_id of the ServiceNow user with the given user name or email, or an empty string when there is none
+func (snClient *ServiceNowClient) GetUserSysID(user string) (string, error) {
+	log.Infof("Get ServiceNow user with user name or email: %s", user)
+	if strings.Contains(user, "^") {
+		// A ^ would alter the encoded query, and match other users
+		log.Warnf("Not searching ServiceNow user %s, as ^ is not allowed in a user name or email", user)
+		return "", nil
+	}
+	params := map[string]string{
+		"sysparm_query":  fmt.Sprintf("user_name=%s^ORemail=%s", user, user),
+		"sysparm_limit":  "1",
+		"sysparm_fields": "sys_id",
+	}
+	response, err := snClient.get("sys_user", params)
+	if err != nil {
+		log.Errorf("Error while getting the user. %s", err)
+		return "", err
+	}
+
+	// Users share the same response format as incidents
+	usersResponse := IncidentsResponse{}
+	err = json.Unmarshal(response, &usersResponse)
+	if err != nil {
+		log.Errorf("Error while unmarshalling the user. %s", err)
+		return "", err
+	}
+
+	users := usersResponse.GetResults()
+	if len(users) == 0 {
+		return "", nil
+	}
+	return users[0].GetSysID(), nil
+}
+
+// CheckHealth will do a lightweight request to ServiceNow to check its availability
+func (snClient *ServiceNowClient) CheckHealth() error {
+	params := map[string]string{
+		"sysparm_limit":    "1",
+		"sysparm_fields":   "sys_id",
+		"sysparm_no_count": "true",
+	}
+	_, err := snClient.get("incident", params)
+	return err
+}
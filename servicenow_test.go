@@ -2,12 +2,22 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var basicIncidentParam = Incident{
@@ -46,6 +56,32 @@ func TestNewServiceNowClient_OK(t *testing.T) {
 	}
 }
 
+func TestNewTransport_Defaults(t *testing.T) {
+	transport := newTransport(0, 0, 0)
+
+	if transport.MaxIdleConns != defaultMaxIdleConns {
+		t.Errorf("Unexpected MaxIdleConns; got: %v, want: %v", transport.MaxIdleConns, defaultMaxIdleConns)
+	}
+	if transport.MaxIdleConnsPerHost != defaultMaxIdleConnsPerHost {
+		t.Errorf("Unexpected MaxIdleConnsPerHost; got: %v, want: %v", transport.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost)
+	}
+	if transport.IdleConnTimeout != defaultIdleConnTimeout {
+		t.Errorf("Unexpected IdleConnTimeout; got: %v, want: %v", transport.IdleConnTimeout, defaultIdleConnTimeout)
+	}
+}
+
+func TestNewServiceNowClientWithBaseURL_OK(t *testing.T) {
+	snClient, err := NewServiceNowClientWithBaseURL(instanceURL("instanceName", "servicenowservices.com"), "userName", "password")
+	if err != nil {
+		t.Fatalf("Error occured %s", err)
+	}
+
+	expectedBaseURL := "https://instanceName.servicenowservices.com"
+	if snClient.baseURL != expectedBaseURL {
+		t.Errorf("Unexpected baseURL; got: %v, want: %v", snClient.baseURL, expectedBaseURL)
+	}
+}
+
 func TestNewServiceNowClient_MissingInstanceName(t *testing.T) {
 	_, err := NewServiceNowClient("", "userName", "password")
 
@@ -216,6 +252,50 @@ func TestCreateIncident_InternalServerError(t *testing.T) {
 	}
 }
 
+func TestCreateIncident_ErrorEnvelope(t *testing.T) {
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"result":{"error":{"message":"Operation Failed","detail":"Rejected by business rule"}}}`)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+
+	if _, err = snClient.CreateIncident(basicIncidentParam); err != nil {
+		t.Errorf("Expected no error without envelope check, got: %s", err)
+	}
+
+	snClient.checkErrorEnvelope = true
+	if _, err = snClient.CreateIncident(basicIncidentParam); err == nil {
+		t.Errorf("Expected an error, got none")
+	}
+}
+
+func TestEnvelopeError(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{name: "root_error", body: `{"error":{"message":"No Record found","detail":"Record doesn't exist"},"status":"failure"}`, wantErr: true},
+		{name: "result_error", body: `{"result":{"error":{"message":"Operation Failed"}}}`, wantErr: true},
+		{name: "incident", body: `{"result":{"number":"INC42","sys_id":"42"}}`, wantErr: false},
+		{name: "incidents", body: `{"result":[{"number":"INC42","sys_id":"42"}]}`, wantErr: false},
+		{name: "error_field", body: `{"result":{"number":"INC42","error":"custom field value"}}`, wantErr: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := envelopeError([]byte(tt.body)); (err != nil) != tt.wantErr {
+				t.Errorf("envelopeError() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestGetIncidents_OK(t *testing.T) {
 	// Load a simple example of a response coming from ServiceNow
 	incidentsTest, err := ioutil.ReadFile("test/get_incidents_response.json")
@@ -247,6 +327,187 @@ func TestGetIncidents_OK(t *testing.T) {
 	}
 }
 
+func TestCreateIncident_MissingNumber(t *testing.T) {
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"result":{"sys_id":"42"}}`)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+
+	incident, err := snClient.CreateIncident(basicIncidentParam)
+	if err != nil {
+		t.Fatalf("Error occured on CreateIncident: %s", err)
+	}
+	if !incident.IsNumberMissing() {
+		t.Errorf("Expected the incident number to be flagged as missing; got: %v", incident)
+	}
+	if incident.GetSysID() != "42" {
+		t.Errorf("Unexpected sys_id; got: %v, want: %v", incident.GetSysID(), "42")
+	}
+}
+
+func TestGetIncidentByNumber(t *testing.T) {
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("number") == "INC42" {
+			fmt.Fprint(w, `{"result":[{"number":"INC42","sys_id":"42"}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"result":[]}`)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+
+	incident, err := snClient.GetIncidentByNumber("INC42")
+	if err != nil {
+		t.Fatalf("Error occured on GetIncidentByNumber: %s", err)
+	}
+	if incident.GetSysID() != "42" {
+		t.Errorf("Unexpected incident; got: %v", incident)
+	}
+
+	if _, err := snClient.GetIncidentByNumber("INC41"); err != errIncidentNotFound {
+		t.Errorf("Unexpected error; got: %v, want: %v", err, errIncidentNotFound)
+	}
+}
+
+func TestGetIncidents_QueryNoDomain(t *testing.T) {
+	var queries []string
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("sysparm_query_no_domain"))
+		fmt.Fprint(w, `{"result":[]}`)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+
+	for _, queryNoDomain := range []bool{false, true} {
+		snClient.queryNoDomain = queryNoDomain
+		if _, err := snClient.GetIncidents(map[string]string{"number": "INC42"}); err != nil {
+			t.Fatalf("Error occured on GetIncidents: %s", err)
+		}
+	}
+
+	want := []string{"", "true"}
+	if !reflect.DeepEqual(queries, want) {
+		t.Errorf("Unexpected sysparm_query_no_domain params; got: %v, want: %v", queries, want)
+	}
+}
+
+func TestGetIncidents_MaxResponseBytes(t *testing.T) {
+	body := `{"result":[{"number":"INC42","sys_id":"42"}]}`
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+
+	snClient.maxResponseBytes = int64(len(body))
+	if _, err := snClient.GetIncidents(map[string]string{"number": "INC42"}); err != nil {
+		t.Errorf("Unexpected error for a response of the maximum size: %s", err)
+	}
+
+	snClient.maxResponseBytes = int64(len(body)) - 1
+	_, err = snClient.GetIncidents(map[string]string{"number": "INC42"})
+	if err == nil || !strings.Contains(err.Error(), "exceeds the maximum size") {
+		t.Errorf("Unexpected error for an oversized response; got: %v", err)
+	}
+}
+
+func TestGetIncidents_MatchTable(t *testing.T) {
+	var paths []string
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		if r.Method == "GET" {
+			fmt.Fprint(w, `{"result":[]}`)
+			return
+		}
+		fmt.Fprint(w, `{"result":{"number":"INC42","sys_id":"42"}}`)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+	snClient.matchTable = "u_open_incidents_view"
+
+	if _, err := snClient.GetIncidents(map[string]string{"number": "INC42"}); err != nil {
+		t.Fatalf("Error occured on GetIncidents: %s", err)
+	}
+	if _, err := snClient.CreateIncident(basicIncidentParam); err != nil {
+		t.Fatalf("Error occured on CreateIncident: %s", err)
+	}
+
+	want := []string{"GET /api/now/v2/table/u_open_incidents_view", "POST /api/now/v2/table/incident"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("Unexpected requests; got: %v, want: %v", paths, want)
+	}
+}
+
+func TestGetIncidents_NoCount(t *testing.T) {
+	incidentsTest, err := ioutil.ReadFile("test/get_incidents_response.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var noCount string
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		noCount = r.URL.Query().Get("sysparm_no_count")
+		fmt.Fprint(w, string(incidentsTest))
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+
+	incidents, err := snClient.GetIncidents(map[string]string{"number": "INC42"})
+	if err != nil {
+		t.Errorf("Error occured on GetIncidents: %s", err)
+	}
+	if noCount != "true" {
+		t.Errorf("Unexpected sysparm_no_count; got: %v, want: %v", noCount, "true")
+	}
+	if len(incidents) == 0 {
+		t.Errorf("Expected incidents, got none")
+	}
+
+	snClient.noCount = false
+	if _, err := snClient.GetIncidents(nil); err != nil {
+		t.Errorf("Error occured on GetIncidents: %s", err)
+	}
+	if noCount != "" {
+		t.Errorf("Unexpected sysparm_no_count; got: %v, want none", noCount)
+	}
+}
+
 func TestGetIncidents_CreateRequestError(t *testing.T) {
 	snClient, err := NewServiceNowClient("instancename", "username", "password")
 	// Cause an error by using an invalid URL
@@ -297,6 +558,34 @@ func TestUpdateIncident_OK(t *testing.T) {
 	}
 }
 
+func TestUpdateIncident_MethodOverride(t *testing.T) {
+	var requests []string
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.Header.Get("X-HTTP-Method-Override"))
+		fmt.Fprint(w, `{"result":{"number":"INC42","sys_id":"my_sys_id"}}`)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+
+	for _, methodOverride := range []string{"", "PATCH"} {
+		snClient.methodOverride = methodOverride
+		if _, err := snClient.UpdateIncident(basicIncidentParam, "my_sys_id"); err != nil {
+			t.Fatalf("Error occured on UpdateIncident: %s", err)
+		}
+	}
+
+	want := []string{"PUT ", "POST PATCH"}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("Unexpected requests; got: %v, want: %v", requests, want)
+	}
+}
+
 func TestUpdateIncident_CreateRequestError(t *testing.T) {
 	snClient, err := NewServiceNowClient("instancename", "username", "password")
 	// Cause an error by using an invalid URL
@@ -312,3 +601,456 @@ func TestUpdateIncident_CreateRequestError(t *testing.T) {
 		t.Errorf("Expected an error, got none")
 	}
 }
+
+func TestGetLatestJournalEntry_OK(t *testing.T) {
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/now/v2/table/sys_journal_field" {
+			t.Errorf("Unexpected path; got: %v", r.URL.Path)
+		}
+		wantQuery := "element_id=42^element=work_notes^ORDERBYDESCsys_created_on"
+		if got := r.URL.Query().Get("sysparm_query"); got != wantQuery {
+			t.Errorf("Unexpected query; got: %v, want: %v", got, wantQuery)
+		}
+		fmt.Fprint(w, `{"result":[{"value":"Latest work note"}]}`)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+
+	got, err := snClient.GetLatestJournalEntry("42", "work_notes")
+	if err != nil {
+		t.Errorf("Error occured on GetLatestJournalEntry: %s", err)
+	}
+	if want := "Latest work note"; got != want {
+		t.Errorf("Unexpected journal entry; got: %v, want: %v", got, want)
+	}
+}
+
+func TestGetUserSysID_OK(t *testing.T) {
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/now/v2/table/sys_user" {
+			t.Errorf("Unexpected path; got: %v", r.URL.Path)
+		}
+		wantQuery := "user_name=jdoe@example.com^ORemail=jdoe@example.com"
+		if got := r.URL.Query().Get("sysparm_query"); got != wantQuery {
+			t.Errorf("Unexpected query; got: %v, want: %v", got, wantQuery)
+		}
+		fmt.Fprint(w, `{"result":[{"sys_id":"user_42"}]}`)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+
+	got, err := snClient.GetUserSysID("jdoe@example.com")
+	if err != nil {
+		t.Errorf("Error occured on GetUserSysID: %s", err)
+	}
+	if want := "user_42"; got != want {
+		t.Errorf("Unexpected sys_id; got: %v, want: %v", got, want)
+	}
+
+	// A user altering the encoded query is not searched
+	snClient.baseURL = "http://127.0.0.1:0"
+	if got, err := snClient.GetUserSysID("nobody^ORactive=true"); err != nil || len(got) > 0 {
+		t.Errorf("Unexpected user with a ^: got %q, %v", got, err)
+	}
+}
+
+func TestDoRequest_Metrics(t *testing.T) {
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"result":{"number":"INC42","sys_id":"42"}}`)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+
+	if _, err := snClient.CreateIncident(basicIncidentParam); err != nil {
+		t.Fatalf("Error occured on CreateIncident: %s", err)
+	}
+
+	rr := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	tsURL, _ := url.Parse(ts.URL)
+	want := fmt.Sprintf(`servicenow_requests_total{code="200",host="%s",method="POST"} 1`, tsURL.Host)
+	if !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("Metric not found in /metrics output; want: %v", want)
+	}
+	if !strings.Contains(rr.Body.String(), "servicenow_last_request_time_seconds") {
+		t.Errorf("Metric servicenow_last_request_time_seconds not found in /metrics output")
+	}
+}
+
+func TestDoRequest_Retry(t *testing.T) {
+	calls := 0
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(r.Body)
+		if !json.Valid(body) {
+			t.Errorf("Unexpected request body on call %d: %s", calls, body)
+		}
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"result":{"number":"INC42","sys_id":"42"}}`)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+	snClient.maxRetries = 3
+	var sleeps []time.Duration
+	snClient.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+	if _, err := snClient.UpdateIncident(basicIncidentParam, "42"); err != nil {
+		t.Fatalf("Error occured on UpdateIncident: %s", err)
+	}
+	if calls != 3 || len(sleeps) != 2 {
+		t.Errorf("Unexpected retries: got %d calls and %d sleeps, want 3 calls and 2 sleeps", calls, len(sleeps))
+	}
+
+	// A creation failing with a server error is not retried, as the incident may have been stored
+	calls = 0
+	if _, err := snClient.CreateIncident(basicIncidentParam); err == nil {
+		t.Errorf("Expected an error, got none")
+	}
+	if calls != 1 {
+		t.Errorf("Unexpected retries of a creation: got %d calls, want 1", calls)
+	}
+}
+
+func TestIncidentsInTable(t *testing.T) {
+	var paths []string
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		fmt.Fprint(w, `{"result":{"number":"INC42","sys_id":"42"}}`)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+
+	if _, err := snClient.CreateIncidentInTable(basicIncidentParam, "u_alert_log"); err != nil {
+		t.Fatalf("Error occured on CreateIncidentInTable: %s", err)
+	}
+	// The match table only applies to searches of the incident table
+	snClient.matchTable = "u_incident_view"
+	if _, err := snClient.GetIncidentsInTable(map[string]string{"number": "INC42"}, "u_alert_log"); err != nil {
+		t.Fatalf("Error occured on GetIncidentsInTable: %s", err)
+	}
+	if _, err := snClient.UpdateIncidentInTable(basicIncidentParam, "42", "u_alert_log"); err != nil {
+		t.Fatalf("Error occured on UpdateIncidentInTable: %s", err)
+	}
+	want := []string{"/api/now/v2/table/u_alert_log", "/api/now/v2/table/u_alert_log", "/api/now/v2/table/u_alert_log/42"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("Unexpected paths; got: %v, want: %v", paths, want)
+	}
+}
+
+func TestCreateIncident_ResultPath(t *testing.T) {
+	body := `{"result":{"record":{"number":"INC42","sys_id":"42"}}}`
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+	snClient.resultPath = "result.record"
+
+	incident, err := snClient.CreateIncident(basicIncidentParam)
+	if err != nil {
+		t.Fatalf("Error occured on CreateIncident: %s", err)
+	}
+	if incident.GetNumber() != "INC42" || incident.GetSysID() != "42" {
+		t.Errorf("Unexpected incident; got: %v", incident)
+	}
+
+	body = `{"result":{"number":"INC42","sys_id":"42"}}`
+	if _, err := snClient.CreateIncident(basicIncidentParam); err == nil || !strings.Contains(err.Error(), "no result.record field") {
+		t.Errorf("Unexpected error for a response without the result path; got: %v", err)
+	}
+}
+
+func TestGetIncidents_ResultPath(t *testing.T) {
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"result":{"records":[{"number":"INC42","sys_id":"42"}]}}`)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+	snClient.resultPath = "result.records"
+
+	incidents, err := snClient.GetIncidents(map[string]string{"number": "INC42"})
+	if err != nil {
+		t.Fatalf("Error occured on GetIncidents: %s", err)
+	}
+	if len(incidents) != 1 || incidents[0].GetNumber() != "INC42" {
+		t.Errorf("Unexpected incidents; got: %v", incidents)
+	}
+}
+
+func TestCreateIncident_Conflict(t *testing.T) {
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+
+	if _, err := snClient.CreateIncident(basicIncidentParam); err != errConflict {
+		t.Errorf("Unexpected error; got: %v, want: %v", err, errConflict)
+	}
+}
+
+func TestDoRequest_NoRetryOnClientError(t *testing.T) {
+	calls := 0
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+	snClient.maxRetries = 3
+	snClient.sleep = func(d time.Duration) {}
+
+	if _, err := snClient.CreateIncident(basicIncidentParam); err == nil {
+		t.Errorf("Expected an error, got none")
+	}
+	if calls != 1 {
+		t.Errorf("Unexpected number of calls: got %d, want 1", calls)
+	}
+}
+
+func TestDoRequest_FailFastThreshold(t *testing.T) {
+	failing := true
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"result":{"number":"INC42","sys_id":"42"}}`)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+	snClient.failFastThreshold = 3
+	var exits []int
+	snClient.exit = func(code int) { exits = append(exits, code) }
+
+	snClient.CreateIncident(basicIncidentParam)
+	snClient.CreateIncident(basicIncidentParam)
+	failing = false
+	if _, err := snClient.CreateIncident(basicIncidentParam); err != nil {
+		t.Fatalf("Error occured on CreateIncident: %s", err)
+	}
+	failing = true
+	snClient.CreateIncident(basicIncidentParam)
+	snClient.CreateIncident(basicIncidentParam)
+	if len(exits) != 0 {
+		t.Fatalf("Unexpected exit before the threshold: %v", exits)
+	}
+
+	snClient.CreateIncident(basicIncidentParam)
+	if !reflect.DeepEqual(exits, []int{1}) {
+		t.Errorf("Unexpected exits: got %v, want [1]", exits)
+	}
+
+	// Requests rejected by ServiceNow are not counted
+	exits = nil
+	snClient.countFailure(nil)
+	for i := 0; i < 3; i++ {
+		snClient.countFailure(errConflict)
+		snClient.countFailure(errors.New("ServiceNow returned the HTTP error code: 400"))
+	}
+	if len(exits) != 0 {
+		t.Errorf("Unexpected exit on rejected requests: %v", exits)
+	}
+}
+
+func TestDoRequest_FailFastThreshold_Hibernating(t *testing.T) {
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html><title>Hibernating Instance</title></html>")
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.baseURL = ts.URL
+	snClient.failFastThreshold = 2
+	var exits []int
+	snClient.exit = func(code int) { exits = append(exits, code) }
+
+	// A hibernating instance answers a 200 status with an HTML page, which tells that ServiceNow is unavailable
+	for i := 0; i < 2; i++ {
+		if _, err := snClient.GetIncidents(map[string]string{}); !isUnavailable(err) {
+			t.Errorf("Unexpected error on a hibernating instance: got %v", err)
+		}
+	}
+	if !reflect.DeepEqual(exits, []int{1}) {
+		t.Errorf("Unexpected exits: got %v, want [1]", exits)
+	}
+}
+
+func TestBackoff_Jitter(t *testing.T) {
+	snClient, err := NewServiceNowClient("instancename", "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClient: %s", err)
+	}
+	snClient.random = rand.New(rand.NewSource(42)).Int63n
+
+	for attempt, max := range []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second} {
+		delays := map[time.Duration]bool{}
+		for i := 0; i < 10; i++ {
+			delay := snClient.backoff(attempt)
+			if delay < 0 || delay > max {
+				t.Errorf("Backoff of attempt %d out of bounds: got %v, want between 0 and %v", attempt, delay, max)
+			}
+			delays[delay] = true
+		}
+		if len(delays) < 2 {
+			t.Errorf("Backoff of attempt %d does not vary: got %v", attempt, delays)
+		}
+	}
+
+	snClient.retryJitter = false
+	if got := snClient.backoff(2); got != 4*time.Second {
+		t.Errorf("Unexpected backoff without jitter: got %v, want %v", got, 4*time.Second)
+	}
+}
+
+func TestGetResults_Malformed(t *testing.T) {
+	response := IncidentsResponse{}
+	if err := json.Unmarshal([]byte(`{"result":[{"number":"INC1"},"INC2",42,{"number":"INC3"}]}`), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	before := testutil.ToFloat64(serviceNowMalformedIncident)
+	incidents := response.GetResults()
+
+	want := []Incident{{"number": "INC1"}, {"number": "INC3"}}
+	if !reflect.DeepEqual(incidents, want) {
+		t.Errorf("Unexpected incidents; got: %v, want: %v", incidents, want)
+	}
+	if got := testutil.ToFloat64(serviceNowMalformedIncident) - before; got != 2 {
+		t.Errorf("Unexpected servicenow_malformed_incident_total increase: got %v, want 2", got)
+	}
+}
+
+func TestDoRequest_UnauthorizedPasswordReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("rotated\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if _, password, _ := r.BasicAuth(); password != "rotated" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"result":{"number":"INC42","sys_id":"42"}}`)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer ts.Close()
+
+	snClient, err := NewServiceNowClientWithBaseURL(ts.URL, "username", "password")
+	if err != nil {
+		t.Fatalf("Error occured on NewServiceNowClientWithBaseURL: %s", err)
+	}
+
+	before := testutil.ToFloat64(serviceNowAuthFailures)
+	if _, err := snClient.CreateIncident(basicIncidentParam); err == nil {
+		t.Errorf("Expected an error without password file, got none")
+	}
+	if calls != 1 {
+		t.Errorf("Unexpected number of calls without password file: got %d, want 1", calls)
+	}
+
+	calls = 0
+	snClient.passwordFile = passwordFile
+	if _, err := snClient.CreateIncident(basicIncidentParam); err != nil {
+		t.Fatalf("Error occured on CreateIncident: %s", err)
+	}
+	if calls != 2 {
+		t.Errorf("Unexpected number of calls with password file: got %d, want 2", calls)
+	}
+	if got := testutil.ToFloat64(serviceNowAuthFailures) - before; got != 2 {
+		t.Errorf("Unexpected servicenow_auth_failures_total increase: got %v, want 2", got)
+	}
+
+	// The password did not change, so the request is not retried
+	calls = 0
+	if err := ioutil.WriteFile(passwordFile, []byte("rotated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	snClient.authHeader = basicAuthHeader("username", "rotated")
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	if _, err := snClient.CreateIncident(basicIncidentParam); err == nil {
+		t.Errorf("Expected an error, got none")
+	}
+	if calls != 1 {
+		t.Errorf("Unexpected number of calls with an unchanged password: got %d, want 1", calls)
+	}
+}